@@ -37,7 +37,13 @@ func TestAllSpecs(t *testing.T) {
 	r.Parallel = false
 
 	r.AddSpec(SyslogWriterSpec)
+	r.AddSpec(CefFormatterSpec)
+	r.AddSpec(LeefFormatterSpec)
+	r.AddSpec(CefDecoderSpec)
+	r.AddSpec(SyslogInputSpec)
 	r.AddSpec(StatsdOutputSpec)
+	r.AddSpec(StatsdClusterSpec)
+	r.AddSpec(StatsdLineDecoderSpec)
 	r.AddSpec(SentryOutputSpec)
 	r.AddSpec(CloudwatchInputSpec)
 
@@ -0,0 +1,281 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	// Ways CefOutput can build the syslog message body.
+	CEF_EVENT_FORMAT_PAYLOAD = "payload"
+	CEF_EVENT_FORMAT_CEF     = "cef"
+	CEF_EVENT_FORMAT_LEEF    = "leef"
+)
+
+// Renders a Heka message as the body of a syslog message.
+type EventFormatter interface {
+	Format(msg *message.Message) string
+}
+
+// CEF header fields, in the order they appear in a record.
+var CEF_HEADER_FIELDS = []string{
+	"device_vendor",
+	"device_product",
+	"device_version",
+	"signature_id",
+	"name",
+	"severity",
+}
+
+var (
+	// Pipes and backslashes are escaped in header fields. Newlines aren't
+	// allowed there at all, so they are replaced with spaces.
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`,
+		"\r\n", " ", "\n", " ", "\r", " ")
+	// Equal signs and backslashes are escaped in extension values, and
+	// newlines are encoded as \n and \r.
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`,
+		"\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+)
+
+// Settings for rendering messages as CEF records.
+type CefConfig struct {
+	// Static header values, used when no message field is mapped to the
+	// header field or the message doesn't have it.
+	DeviceVendor  string `toml:"device_vendor"`
+	DeviceProduct string `toml:"device_product"`
+	DeviceVersion string `toml:"device_version"`
+	SignatureId   string `toml:"signature_id"`
+	Name          string `toml:"name"`
+	Severity      string `toml:"severity"`
+	// Map of CEF header fields, named as in CEF_HEADER_FIELDS, to the
+	// message fields holding their values.
+	HeaderFields map[string]string `toml:"header_fields"`
+	// Map of CEF extension keys to the message fields holding their
+	// values. Extensions whose field is missing are left out.
+	Extensions map[string]string `toml:"extensions"`
+}
+
+// Renders Heka messages as CEF records.
+type CefFormatter struct {
+	header       []string // static values, in CEF_HEADER_FIELDS order
+	headerFields []string // mapped message fields, in the same order
+	extKeys      []string
+	extFields    map[string]string
+}
+
+func NewCefFormatter(conf *CefConfig) (*CefFormatter, error) {
+	f := &CefFormatter{
+		header: []string{conf.DeviceVendor, conf.DeviceProduct, conf.DeviceVersion,
+			conf.SignatureId, conf.Name, conf.Severity},
+		headerFields: make([]string, len(CEF_HEADER_FIELDS)),
+		extFields:    conf.Extensions,
+	}
+	for name, field := range conf.HeaderFields {
+		i := stringIndex(CEF_HEADER_FIELDS, name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown CEF header field: %s", name)
+		}
+		f.headerFields[i] = field
+	}
+	for key := range conf.Extensions {
+		if !validCefKey(key) {
+			return nil, fmt.Errorf("invalid CEF extension key: %s", key)
+		}
+		f.extKeys = append(f.extKeys, key)
+	}
+	sort.Strings(f.extKeys)
+	return f, nil
+}
+
+// Format renders msg as a CEF record. Extensions are written in key
+// order so records are stable.
+func (f *CefFormatter) Format(msg *message.Message) string {
+	parts := make([]string, 0, len(f.header)+2)
+	parts = append(parts, "CEF:0")
+	for i, value := range f.header {
+		if v, ok := firstFieldValue(msg, f.headerFields[i]); ok {
+			value = v
+		}
+		parts = append(parts, cefHeaderEscaper.Replace(value))
+	}
+
+	ext := make([]string, 0, len(f.extKeys))
+	for _, key := range f.extKeys {
+		if v, ok := firstFieldValue(msg, f.extFields[key]); ok {
+			ext = append(ext, key+"="+cefExtensionEscaper.Replace(v))
+		}
+	}
+	parts = append(parts, strings.Join(ext, " "))
+	return strings.Join(parts, "|")
+}
+
+// A parsed CEF record.
+type CefRecord struct {
+	Version int
+	// Header values, in CEF_HEADER_FIELDS order.
+	Header     []string
+	Extensions []CefExtension
+}
+
+// A single CEF extension key/value pair.
+type CefExtension struct {
+	Key   string
+	Value string
+}
+
+// ParseCefRecord parses a CEF record, unescaping the header fields and
+// extension values. Extension values run up to the next unescaped
+// "key=", so they may contain spaces.
+func ParseCefRecord(s string) (*CefRecord, error) {
+	if !strings.HasPrefix(s, "CEF:") {
+		return nil, errors.New("not a CEF record")
+	}
+	s = s[len("CEF:"):]
+
+	parts := make([]string, 0, len(CEF_HEADER_FIELDS)+1)
+	buf := make([]byte, 0, len(s))
+	i := 0
+	for ; i < len(s) && len(parts) <= len(CEF_HEADER_FIELDS); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '|' || s[i+1] == '\\') {
+				i++
+				c = s[i]
+			}
+			buf = append(buf, c)
+		case '|':
+			parts = append(parts, string(buf))
+			buf = buf[:0]
+		default:
+			buf = append(buf, c)
+		}
+	}
+	if len(parts) <= len(CEF_HEADER_FIELDS) {
+		return nil, errors.New("truncated CEF header")
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CEF version: %s", parts[0])
+	}
+	return &CefRecord{
+		Version:    version,
+		Header:     parts[1:],
+		Extensions: parseCefExtensions(s[i:]),
+	}, nil
+}
+
+func parseCefExtensions(s string) (extensions []CefExtension) {
+	// Find every unescaped "=" preceded by a valid key.
+	type keyMark struct{ start, eq int }
+	var marks []keyMark
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			start := strings.LastIndexByte(s[:i], ' ') + 1
+			if validCefKey(s[start:i]) {
+				marks = append(marks, keyMark{start, i})
+			}
+		}
+	}
+	for j, m := range marks {
+		var value string
+		if j+1 < len(marks) {
+			value = s[m.eq+1 : marks[j+1].start-1]
+		} else {
+			value = strings.TrimRight(s[m.eq+1:], " ")
+		}
+		extensions = append(extensions,
+			CefExtension{s[m.start:m.eq], cefExtensionUnescape(value)})
+	}
+	return
+}
+
+func cefExtensionUnescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case '\\', '=', '|':
+				c = s[i+1]
+				i++
+			case 'n':
+				c = '\n'
+				i++
+			case 'r':
+				c = '\r'
+				i++
+			}
+		}
+		buf = append(buf, c)
+	}
+	return string(buf)
+}
+
+// firstFieldValue returns the first value of the named message field as a
+// string.
+func firstFieldValue(msg *message.Message, name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	field := msg.FindFirstField(name)
+	if field == nil {
+		return "", false
+	}
+	values := fieldValueStrings(field)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// validCefKey reports whether key can be used as a CEF extension key,
+// which may only contain letters, digits, dots and underscores.
+func validCefKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func stringIndex(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
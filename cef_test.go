@@ -0,0 +1,227 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func newCefTestMessage(fields map[string]interface{}) *message.Message {
+	msg := new(message.Message)
+	for name, value := range fields {
+		f, _ := message.NewField(name, value, "")
+		msg.AddField(f)
+	}
+	return msg
+}
+
+func CefFormatterSpec(c gs.Context) {
+	conf := &CefConfig{
+		DeviceVendor:  "security",
+		DeviceProduct: "threatmanager",
+		DeviceVersion: "1.0",
+		SignatureId:   "100",
+		Severity:      "10",
+		HeaderFields:  map[string]string{"name": "event_name"},
+		Extensions: map[string]string{
+			"src": "src_ip",
+			"dst": "dst_ip",
+			"spt": "src_port",
+			"act": "action",
+		},
+	}
+
+	c.Specify("A CefFormatter", func() {
+		f, err := NewCefFormatter(conf)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("renders the header and extensions", func() {
+			msg := newCefTestMessage(map[string]interface{}{
+				"event_name": "worm successfully stopped",
+				"src_ip":     "10.0.0.1",
+				"dst_ip":     "2.1.2.2",
+				"src_port":   1232,
+			})
+			c.Expect(f.Format(msg), gs.Equals,
+				"CEF:0|security|threatmanager|1.0|100|worm successfully stopped|10|"+
+					"dst=2.1.2.2 spt=1232 src=10.0.0.1")
+		})
+
+		c.Specify("escapes pipes and backslashes in the header", func() {
+			msg := newCefTestMessage(map[string]interface{}{
+				"event_name": `detected a | in message`,
+				"src_ip":     "10.0.0.1",
+			})
+			c.Expect(f.Format(msg), gs.Equals,
+				`CEF:0|security|threatmanager|1.0|100|detected a \| in message|10|src=10.0.0.1`)
+
+			msg = newCefTestMessage(map[string]interface{}{
+				"event_name": `detected a \ in packet`,
+			})
+			c.Expect(f.Format(msg), gs.Equals,
+				`CEF:0|security|threatmanager|1.0|100|detected a \\ in packet|10|`)
+		})
+
+		c.Specify("escapes equal signs, backslashes and newlines in extensions", func() {
+			msg := newCefTestMessage(map[string]interface{}{
+				"event_name": "detected an = in message",
+				"src_ip":     "10.0.0.1",
+				"action":     "blocked a =",
+				"dst_ip":     "1.1.1.1",
+			})
+			c.Expect(f.Format(msg), gs.Equals,
+				"CEF:0|security|threatmanager|1.0|100|detected an = in message|10|"+
+					`act=blocked a \= dst=1.1.1.1 src=10.0.0.1`)
+
+			msg = newCefTestMessage(map[string]interface{}{
+				"event_name": "multi\nline",
+				"action":     "c:\\tmp\r\nnext|line",
+			})
+			c.Expect(f.Format(msg), gs.Equals,
+				"CEF:0|security|threatmanager|1.0|100|multi line|10|"+
+					`act=c:\\tmp\nnext|line`)
+		})
+
+		c.Specify("falls back to the static header values", func() {
+			c.Expect(f.Format(new(message.Message)), gs.Equals,
+				"CEF:0|security|threatmanager|1.0|100||10|")
+		})
+	})
+
+	c.Specify("rejects unknown header fields", func() {
+		conf.HeaderFields = map[string]string{"vendor": "v"}
+		_, err := NewCefFormatter(conf)
+		c.Expect(err.Error(), gs.Equals, "unknown CEF header field: vendor")
+	})
+
+	c.Specify("rejects invalid extension keys", func() {
+		conf.Extensions = map[string]string{"src ip": "src_ip"}
+		_, err := NewCefFormatter(conf)
+		c.Expect(err.Error(), gs.Equals, "invalid CEF extension key: src ip")
+	})
+}
+
+func CefDecoderSpec(c gs.Context) {
+	decoder := new(CefDecoder)
+	decoder.Init(decoder.ConfigStruct())
+	pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+	record := `CEF:0|security|threatmanager|1.0|100|detected a \| in message|10|` +
+		`src=10.0.0.1 act=blocked a \= dst=1.1.1.1 msg=multi\nline with spaces spt=1232`
+
+	fieldValue := func(name string) interface{} {
+		value, _ := pack.Message.GetFieldValue(name)
+		return value
+	}
+
+	c.Specify("A CefDecoder", func() {
+		c.Specify("decodes the header and extensions", func() {
+			pack.Message.SetPayload(record)
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+
+			c.Expect(pack.Message.GetType(), gs.Equals, "cef")
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(2))
+			c.Expect(fieldValue("cef_version"), gs.Equals, int64(0))
+			c.Expect(fieldValue("device_vendor"), gs.Equals, "security")
+			c.Expect(fieldValue("name"), gs.Equals, "detected a | in message")
+			c.Expect(fieldValue("severity"), gs.Equals, "10")
+			c.Expect(fieldValue("src"), gs.Equals, "10.0.0.1")
+			c.Expect(fieldValue("act"), gs.Equals, "blocked a =")
+			c.Expect(fieldValue("dst"), gs.Equals, "1.1.1.1")
+			c.Expect(fieldValue("msg"), gs.Equals, "multi\nline with spaces")
+			c.Expect(fieldValue("spt"), gs.Equals, int64(1232))
+		})
+
+		c.Specify("decodes an RFC 3164 syslog header", func() {
+			pack.Message.SetPayload("<134>Mar  5 11:22:33 fw1 appliance[42]: " + record)
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+
+			ts := time.Unix(0, pack.Message.GetTimestamp())
+			c.Expect(ts.Format(time.Stamp), gs.Equals, "Mar  5 11:22:33")
+			c.Expect(pack.Message.GetHostname(), gs.Equals, "fw1")
+			c.Expect(pack.Message.GetPid(), gs.Equals, int32(42))
+			c.Expect(fieldValue("cef_meta.syslog_facility"), gs.Equals, "LOCAL0")
+			c.Expect(fieldValue("cef_meta.syslog_priority"), gs.Equals, "INFO")
+			c.Expect(fieldValue("cef_meta.syslog_ident"), gs.Equals, "appliance")
+			// The CEF severity wins over the syslog one.
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(2))
+		})
+
+		c.Specify("decodes an RFC 5424 syslog header", func() {
+			pack.Message.SetPayload("<165>1 2014-03-05T11:22:33.5Z fw2 appliance 7 - - " + record)
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+
+			c.Expect(pack.Message.GetTimestamp(), gs.Equals,
+				time.Date(2014, 3, 5, 11, 22, 33, 5e8, time.UTC).UnixNano())
+			c.Expect(pack.Message.GetHostname(), gs.Equals, "fw2")
+			c.Expect(pack.Message.GetPid(), gs.Equals, int32(7))
+			c.Expect(fieldValue("cef_meta.syslog_facility"), gs.Equals, "LOCAL4")
+			c.Expect(fieldValue("cef_meta.syslog_priority"), gs.Equals, "NOTICE")
+		})
+
+		c.Specify("accepts a syslog header without a priority", func() {
+			pack.Message.SetPayload("Mar  5 11:22:33 fw3 " + record)
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+			c.Expect(pack.Message.GetHostname(), gs.Equals, "fw3")
+			c.Expect(fieldValue("src"), gs.Equals, "10.0.0.1")
+		})
+
+		c.Specify("maps CEF severities", func() {
+			for sev, exp := range map[string]int32{"0": 6, "5": 4, "8": 3, "Very-High": 2} {
+				pack.Message = new(message.Message)
+				pack.Message.SetPayload("CEF:0|v|p|1|sig|name|" + sev + "|")
+				_, err := decoder.Decode(pack)
+				c.Assume(err, gs.IsNil)
+				c.Expect(pack.Message.GetSeverity(), gs.Equals, exp)
+			}
+		})
+
+		c.Specify("round trips through a CefFormatter", func() {
+			pack.Message.SetPayload(record)
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+
+			conf := &CefConfig{HeaderFields: make(map[string]string),
+				Extensions: make(map[string]string)}
+			for _, name := range CEF_HEADER_FIELDS {
+				conf.HeaderFields[name] = name
+			}
+			for _, key := range []string{"src", "act", "dst", "msg", "spt"} {
+				conf.Extensions[key] = key
+			}
+			f, err := NewCefFormatter(conf)
+			c.Assume(err, gs.IsNil)
+			c.Expect(f.Format(pack.Message), gs.Equals,
+				`CEF:0|security|threatmanager|1.0|100|detected a \| in message|10|`+
+					`act=blocked a \= dst=1.1.1.1 msg=multi\nline with spaces spt=1232 src=10.0.0.1`)
+		})
+
+		c.Specify("rejects payloads without a CEF record", func() {
+			pack.Message.SetPayload("just a log line")
+			_, err := decoder.Decode(pack)
+			c.Expect(err.Error(), gs.Equals, "no CEF record in payload")
+
+			pack.Message.SetPayload("CEF:0|vendor|product")
+			_, err = decoder.Decode(pack)
+			c.Expect(err.Error(), gs.Equals, "truncated CEF header")
+		})
+	})
+}
@@ -0,0 +1,385 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+var (
+	// Standard CEF extension keys holding integers.
+	CEF_INTEGER_EXTENSIONS = map[string]bool{
+		"cn1": true, "cn2": true, "cn3": true, "cnt": true,
+		"destinationTranslatedPort": true, "dpid": true, "dpt": true,
+		"dvcpid": true, "fsize": true, "in": true, "oldFileSize": true,
+		"out": true, "sourceTranslatedPort": true, "spid": true, "spt": true,
+	}
+	// Standard CEF extension keys holding floating point numbers.
+	CEF_FLOAT_EXTENSIONS = map[string]bool{
+		"cfp1": true, "cfp2": true, "cfp3": true, "cfp4": true,
+		"dlat": true, "dlong": true, "slat": true, "slong": true,
+	}
+	// Heka severities for the CEF severity names. Numeric CEF severities
+	// 0-3 are Low, 4-6 Medium, 7-8 High and 9-10 Very-High.
+	CEF_SEVERITY = map[string]int32{
+		"low":       int32(syslog.LOG_INFO),
+		"medium":    int32(syslog.LOG_WARNING),
+		"high":      int32(syslog.LOG_ERR),
+		"very-high": int32(syslog.LOG_CRIT),
+	}
+)
+
+// Decodes message payloads holding CEF records, optionally wrapped in a
+// syslog header, into message fields that CefOutput can render again.
+type CefDecoder struct {
+	msgType string
+}
+
+type CefDecoderConfig struct {
+	// Type of the decoded messages. Defaults to "cef".
+	Type string `toml:"type"`
+}
+
+func (cd *CefDecoder) ConfigStruct() interface{} {
+	return &CefDecoderConfig{Type: "cef"}
+}
+
+func (cd *CefDecoder) Init(config interface{}) (err error) {
+	conf := config.(*CefDecoderConfig)
+	cd.msgType = conf.Type
+	return
+}
+
+func (cd *CefDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	payload := pack.Message.GetPayload()
+	start := strings.Index(payload, "CEF:")
+	if start < 0 {
+		return nil, errors.New("no CEF record in payload")
+	}
+	record, err := ParseCefRecord(payload[start:])
+	if err != nil {
+		return nil, err
+	}
+
+	msg := pack.Message
+	if start > 0 {
+		if err = cd.decodeSyslogHeader(payload[:start], msg); err != nil {
+			return nil, err
+		}
+	}
+	msg.SetType(cd.msgType)
+	addMessageField(msg, "cef_version", record.Version)
+	for i, name := range CEF_HEADER_FIELDS {
+		addMessageField(msg, name, record.Header[i])
+	}
+	if severity, ok := cefSeverity(record.Header[5]); ok {
+		msg.SetSeverity(severity)
+	}
+	for _, ext := range record.Extensions {
+		addMessageField(msg, ext.Key, typedCefValue(ext.Key, ext.Value))
+	}
+	return []*pipeline.PipelinePack{pack}, nil
+}
+
+// decodeSyslogHeader copies what the syslog header carries onto msg,
+// including the cef_meta fields CefOutput reads its syslog metadata from.
+// Appliances writing to files often leave out the priority, so headers
+// without one are accepted too.
+func (cd *CefDecoder) decodeSyslogHeader(header string, msg *message.Message) error {
+	header = strings.TrimRight(header, " ")
+	if !strings.HasPrefix(header, "<") {
+		sm := new(SyslogMsg)
+		parseBsdSyslog(header, sm)
+		copySyslogHeader(sm, msg)
+		return nil
+	}
+	sm, err := ParseSyslogMsg(header)
+	if err != nil {
+		return err
+	}
+	copySyslogHeader(sm, msg)
+	copySyslogPriority(sm, msg)
+	return nil
+}
+
+// copySyslogHeader sets a message's hostname, timestamp and pid from a
+// parsed syslog header, and its cef_meta.syslog_ident field from the tag.
+func copySyslogHeader(sm *SyslogMsg, msg *message.Message) {
+	if sm.hostname != "" {
+		msg.SetHostname(sm.hostname)
+	}
+	if !sm.timestamp.IsZero() {
+		msg.SetTimestamp(sm.timestamp.UnixNano())
+	}
+	if sm.pid != 0 {
+		msg.SetPid(int32(sm.pid))
+	}
+	if sm.prefix != "" {
+		addMessageField(msg, "cef_meta.syslog_ident", sm.prefix)
+	}
+}
+
+// copySyslogPriority sets a message's Severity and its
+// cef_meta.syslog_priority and cef_meta.syslog_facility fields from a
+// parsed syslog priority.
+func copySyslogPriority(sm *SyslogMsg, msg *message.Message) {
+	msg.SetSeverity(int32(sm.priority & 7))
+	for name, p := range SYSLOG_PRIORITY {
+		if p == sm.priority&7 {
+			addMessageField(msg, "cef_meta.syslog_priority", name)
+		}
+	}
+	for name, f := range SYSLOG_FACILITY {
+		if f == sm.priority&^7 {
+			addMessageField(msg, "cef_meta.syslog_facility", name)
+		}
+	}
+}
+
+func addMessageField(msg *message.Message, name string, value interface{}) {
+	if f, err := message.NewField(name, value, ""); err == nil {
+		msg.AddField(f)
+	}
+}
+
+// typedCefValue converts the values of the standard numeric extensions,
+// leaving anything it can't parse as a string.
+func typedCefValue(key, value string) interface{} {
+	if CEF_INTEGER_EXTENSIONS[key] {
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	} else if CEF_FLOAT_EXTENSIONS[key] {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return value
+}
+
+// cefSeverity maps a CEF severity, either 0-10 or a name, to a Heka
+// severity.
+func cefSeverity(s string) (int32, bool) {
+	if n, err := strconv.Atoi(s); err == nil {
+		switch {
+		case n < 0 || n > 10:
+			return 0, false
+		case n <= 3:
+			s = "low"
+		case n <= 6:
+			s = "medium"
+		case n <= 8:
+			s = "high"
+		default:
+			s = "very-high"
+		}
+	}
+	severity, ok := CEF_SEVERITY[strings.ToLower(s)]
+	return severity, ok
+}
+
+// Message types for the statsd line metric types.
+var STATSD_LINE_TYPES = map[string]string{
+	STATSD_COUNTER:   "counter",
+	STATSD_TIMER:     "timer",
+	STATSD_GAUGE:     "gauge",
+	STATSD_SET:       "set",
+	STATSD_HISTOGRAM: "histogram",
+}
+
+// Decodes message payloads holding statsd lines, such as
+// `bucket:1|c|@0.5|#env:prod`, into the messages StatsdOutput and
+// HekaStatsFilter read: the metric type as the Type, the bucket in a
+// "name" field, the sample rate in a "rate" field and the value as the
+// payload. Each DogStatsD tag becomes a field. A payload holding several
+// lines, as statsd clients batch them into one packet, becomes one message
+// per line.
+type StatsdLineDecoder struct {
+	tagPrefix string
+	dRunner   pipeline.DecoderRunner
+}
+
+type StatsdLineDecoderConfig struct {
+	// Prepended to the names of the tag fields. Optional.
+	TagPrefix string `toml:"tag_prefix"`
+}
+
+// A parsed statsd line.
+type statsdMetricLine struct {
+	bucket  string
+	msgType string
+	value   string
+	rate    float64
+	tags    []string
+}
+
+func (sd *StatsdLineDecoder) ConfigStruct() interface{} {
+	return new(StatsdLineDecoderConfig)
+}
+
+func (sd *StatsdLineDecoder) Init(config interface{}) (err error) {
+	conf := config.(*StatsdLineDecoderConfig)
+	sd.tagPrefix = conf.TagPrefix
+	return
+}
+
+// SetDecoderRunner is called before Decode, giving access to the packs
+// the extra lines of a payload are decoded into.
+func (sd *StatsdLineDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
+	sd.dRunner = dr
+}
+
+// Decode decodes every line of the payload, skipping empty ones. The first
+// line is decoded into pack, and the others into new packs copying its
+// headers. A malformed line is logged and skipped, unless no line can be
+// decoded, when the payload is rejected.
+func (sd *StatsdLineDecoder) Decode(pack *pipeline.PipelinePack) (
+	packs []*pipeline.PipelinePack, err error) {
+
+	var lines []*statsdMetricLine
+	var errs []error
+	for _, text := range strings.Split(pack.Message.GetPayload(), "\n") {
+		text = strings.TrimRight(text, "\r")
+		if text == "" {
+			continue
+		}
+		if line, e := parseStatsdLine(text); e != nil {
+			errs = append(errs, e)
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	switch {
+	case len(lines) == 0 && len(errs) == 0:
+		return nil, errors.New("statsd payload holds no lines")
+	case len(lines) == 0:
+		return nil, errs[0]
+	case len(lines) > 1 && sd.dRunner == nil:
+		return nil, errors.New("statsd payload holds several lines but " +
+			"there's no decoder runner")
+	}
+	if sd.dRunner != nil {
+		for _, e := range errs {
+			sd.dRunner.LogError(e)
+		}
+	}
+
+	var header *message.Message
+	if len(lines) > 1 {
+		header = pack.Message.Copy()
+	}
+	packs = make([]*pipeline.PipelinePack, 0, len(lines))
+	for i, line := range lines {
+		p := pack
+		if i > 0 {
+			p = sd.dRunner.NewPack()
+			p.Message = header.Copy()
+			p.Message.SetUuid(uuid.NewRandom())
+		}
+		sd.fillMessage(p.Message, line)
+		packs = append(packs, p)
+	}
+	return packs, nil
+}
+
+func parseStatsdLine(text string) (line *statsdMetricLine, err error) {
+	sep := strings.Index(text, ":")
+	if sep <= 0 {
+		return nil, fmt.Errorf("statsd line has no bucket name: %s", text)
+	}
+	sections := strings.Split(text[sep+1:], "|")
+	if len(sections) < 2 {
+		return nil, fmt.Errorf("statsd line has no metric type: %s", text)
+	}
+	line = &statsdMetricLine{bucket: text[:sep], value: sections[0], rate: 1.0}
+	var ok bool
+	if line.msgType, ok = STATSD_LINE_TYPES[sections[1]]; !ok {
+		return nil, fmt.Errorf("unknown statsd metric type: %s", sections[1])
+	}
+	switch line.msgType {
+	case "counter":
+		// StatsdOutput only sends whole counts.
+		if _, err := strconv.ParseInt(line.value, 10, 64); err != nil {
+			return nil, fmt.Errorf("statsd line counter is not a whole number: %s",
+				line.value)
+		}
+	case "set":
+		if line.value == "" {
+			return nil, errors.New("statsd line has no set member")
+		}
+	default:
+		// Gauge adjustments are signed, which ParseFloat accepts.
+		f, err := strconv.ParseFloat(line.value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("statsd line value is not a number: %s", line.value)
+		}
+	}
+
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			line.rate, err = strconv.ParseFloat(section[1:], 64)
+			if err != nil || !(line.rate > 0 && line.rate <= 1) {
+				return nil, fmt.Errorf("invalid statsd sample rate: %s", section[1:])
+			}
+		case strings.HasPrefix(section, "#"):
+			line.tags = strings.Split(section[1:], ",")
+		default:
+			return nil, fmt.Errorf("unknown statsd line section: %s", section)
+		}
+	}
+	return line, nil
+}
+
+func (sd *StatsdLineDecoder) fillMessage(msg *message.Message, line *statsdMetricLine) {
+	// StatsdOutput and HekaStatsFilter prefix the name with the Logger,
+	// while the bucket is already complete.
+	msg.SetLogger("")
+	msg.SetType(line.msgType)
+	msg.SetPayload(line.value)
+	addMessageField(msg, "name", line.bucket)
+	addMessageField(msg, "rate", line.rate)
+	for _, tag := range line.tags {
+		key, tagValue := tag, ""
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key, tagValue = tag[:i], tag[i+1:]
+		}
+		name := sd.tagPrefix + key
+		if key == "" || name == "name" || name == "rate" {
+			continue
+		}
+		addMessageField(msg, name, tagValue)
+	}
+}
+
+func init() {
+	pipeline.RegisterPlugin("CefDecoder", func() interface{} {
+		return new(CefDecoder)
+	})
+	pipeline.RegisterPlugin("StatsdLineDecoder", func() interface{} {
+		return new(StatsdLineDecoder)
+	})
+}
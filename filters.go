@@ -16,14 +16,17 @@ package heka_mozsvc_plugins
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/mozilla-services/heka/pipeline"
 )
 
-// A filter that expects `counter` or `timer` type messages that have come in
-// via a heka client and injects them into the StatMonitor so the system
-// behaves exactly as though they came in through the StatsdInput.
+// A filter that expects `counter`, `timer` or `gauge` type messages that have
+// come in via a heka client and injects them into the StatMonitor so the
+// system behaves exactly as though they came in through the StatsdInput.
+// Sets, histograms and gauge adjustments have no StatAccumulator
+// counterpart and are rejected.
 type HekaStatsFilter struct {
 	statAccumName string
 }
@@ -94,9 +97,22 @@ func (hsf *HekaStatsFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelpe
 		stat.Bucket = name
 		stat.Value = pack.Message.GetPayload()
 		stat.Sampling = float32(rate)
-		if pack.Message.GetType() == "timer" {
+		switch msgType := pack.Message.GetType(); msgType {
+		case "timer":
 			stat.Modifier = "ms"
-		} else {
+		case "gauge":
+			// The StatAccumulator sets gauges, it can't adjust them.
+			if strings.HasPrefix(stat.Value, "+") || strings.HasPrefix(stat.Value, "-") {
+				fr.UpdateCursor(pack.QueueCursor)
+				pack.Recycle(errors.New("stats message adjusts a gauge"))
+				continue
+			}
+			stat.Modifier = "g"
+		case "set", "histogram":
+			fr.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(fmt.Errorf("stats message type not supported: %s", msgType))
+			continue
+		default:
 			stat.Modifier = ""
 		}
 		statAccum.DropStat(stat)
@@ -0,0 +1,179 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+const (
+	LEEF_VERSION_1 = "1.0"
+	LEEF_VERSION_2 = "2.0"
+)
+
+// LEEF header fields, in the order they appear in a record.
+var LEEF_HEADER_FIELDS = []string{
+	"vendor",
+	"product",
+	"product_version",
+	"event_id",
+}
+
+// Pipes and backslashes are escaped in header fields, and newlines are
+// replaced with spaces.
+var leefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`,
+	"\r\n", " ", "\n", " ", "\r", " ")
+
+// Settings for rendering messages as LEEF records.
+type LeefConfig struct {
+	// LEEF version, "1.0" or "2.0".
+	Version string `toml:"version"`
+	// Attribute delimiter for LEEF 2.0, either a single character or its
+	// hex value prefixed with "x" or "0x". Defaults to a tab, which is the
+	// only delimiter LEEF 1.0 supports.
+	Delimiter string `toml:"delimiter"`
+	// Static header values, used when no message field is mapped to the
+	// header field or the message doesn't have it.
+	Vendor         string `toml:"vendor"`
+	Product        string `toml:"product"`
+	ProductVersion string `toml:"product_version"`
+	EventId        string `toml:"event_id"`
+	// Map of LEEF header fields, named as in LEEF_HEADER_FIELDS, to the
+	// message fields holding their values.
+	HeaderFields map[string]string `toml:"header_fields"`
+	// Map of LEEF attribute keys to the message fields holding their
+	// values. Attributes whose field is missing are left out.
+	Attributes map[string]string `toml:"attributes"`
+}
+
+// Renders Heka messages as LEEF records.
+type LeefFormatter struct {
+	version      string
+	delimiter    string
+	header       []string // static values, in LEEF_HEADER_FIELDS order
+	headerFields []string // mapped message fields, in the same order
+	attrKeys     []string
+	attrFields   map[string]string
+	escaper      *strings.Replacer
+}
+
+func NewLeefFormatter(conf *LeefConfig) (*LeefFormatter, error) {
+	f := &LeefFormatter{
+		header: []string{conf.Vendor, conf.Product, conf.ProductVersion,
+			conf.EventId},
+		headerFields: make([]string, len(LEEF_HEADER_FIELDS)),
+		attrFields:   conf.Attributes,
+		delimiter:    "\t",
+	}
+
+	switch conf.Version {
+	case LEEF_VERSION_1:
+		if conf.Delimiter != "" && conf.Delimiter != "\t" {
+			return nil, errors.New("LEEF 1.0 only supports tab delimiters")
+		}
+	case LEEF_VERSION_2:
+		if conf.Delimiter != "" {
+			var err error
+			if f.delimiter, err = parseLeefDelimiter(conf.Delimiter); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown LEEF version: %s", conf.Version)
+	}
+	f.version = conf.Version
+	// Backslashes and the delimiter are escaped in attribute values, and
+	// newlines are encoded as \n and \r.
+	f.escaper = strings.NewReplacer(`\`, `\\`, f.delimiter, `\`+f.delimiter,
+		"\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+
+	for name, field := range conf.HeaderFields {
+		i := stringIndex(LEEF_HEADER_FIELDS, name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown LEEF header field: %s", name)
+		}
+		f.headerFields[i] = field
+	}
+	for key := range conf.Attributes {
+		if !validCefKey(key) {
+			return nil, fmt.Errorf("invalid LEEF attribute key: %s", key)
+		}
+		f.attrKeys = append(f.attrKeys, key)
+	}
+	sort.Strings(f.attrKeys)
+	return f, nil
+}
+
+// parseLeefDelimiter accepts a single character or its hex value, as in
+// "^", "x5E" or "0x5E".
+func parseLeefDelimiter(s string) (string, error) {
+	d := s
+	if len(s) > 1 {
+		hex := strings.ToLower(s)
+		switch {
+		case strings.HasPrefix(hex, "0x"):
+			hex = hex[2:]
+		case strings.HasPrefix(hex, "x"):
+			hex = hex[1:]
+		default:
+			return "", fmt.Errorf("invalid LEEF delimiter: %s", s)
+		}
+		b, err := strconv.ParseUint(hex, 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid LEEF delimiter: %s", s)
+		}
+		d = string([]byte{byte(b)})
+	}
+	if d[0] > 0x7f || strings.ContainsAny(d, "|=\\\r\n") {
+		return "", fmt.Errorf("invalid LEEF delimiter: %s", s)
+	}
+	return d, nil
+}
+
+// Format renders msg as a LEEF record. Attributes are written in key order
+// so records are stable.
+func (f *LeefFormatter) Format(msg *message.Message) string {
+	parts := make([]string, 0, len(f.header)+3)
+	parts = append(parts, "LEEF:"+f.version)
+	for i, value := range f.header {
+		if v, ok := firstFieldValue(msg, f.headerFields[i]); ok {
+			value = v
+		}
+		parts = append(parts, leefHeaderEscaper.Replace(value))
+	}
+	if f.version == LEEF_VERSION_2 {
+		// Unprintable delimiters are given as hex values.
+		if d := f.delimiter[0]; d > ' ' && d < 0x7f {
+			parts = append(parts, f.delimiter)
+		} else {
+			parts = append(parts, fmt.Sprintf("x%02X", d))
+		}
+	}
+
+	attrs := make([]string, 0, len(f.attrKeys))
+	for _, key := range f.attrKeys {
+		if v, ok := firstFieldValue(msg, f.attrFields[key]); ok {
+			attrs = append(attrs, key+"="+f.escaper.Replace(v))
+		}
+	}
+	parts = append(parts, strings.Join(attrs, f.delimiter))
+	return strings.Join(parts, "|")
+}
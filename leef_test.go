@@ -0,0 +1,120 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func LeefFormatterSpec(c gs.Context) {
+	conf := &LeefConfig{
+		Version:        LEEF_VERSION_1,
+		Vendor:         "Lancope",
+		Product:        "StealthWatch",
+		ProductVersion: "1.0",
+		HeaderFields:   map[string]string{"event_id": "event"},
+		Attributes: map[string]string{
+			"src": "src_ip",
+			"dst": "dst_ip",
+			"msg": "detail",
+		},
+	}
+	msg := newCefTestMessage(map[string]interface{}{
+		"event":  "41",
+		"src_ip": "192.0.2.1",
+		"dst_ip": "198.51.100.2",
+	})
+
+	c.Specify("A LEEF 1.0 formatter", func() {
+		f, err := NewLeefFormatter(conf)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("separates attributes with tabs", func() {
+			c.Expect(f.Format(msg), gs.Equals,
+				"LEEF:1.0|Lancope|StealthWatch|1.0|41|dst=198.51.100.2\tsrc=192.0.2.1")
+		})
+
+		c.Specify("escapes the header and attribute values", func() {
+			msg = newCefTestMessage(map[string]interface{}{
+				"event":  "a|b",
+				"detail": "tab\there\nand \\ there",
+			})
+			c.Expect(f.Format(msg), gs.Equals,
+				`LEEF:1.0|Lancope|StealthWatch|1.0|a\|b|msg=tab\`+"\t"+`here\nand \\ there`)
+		})
+
+		c.Specify("falls back to the static header values", func() {
+			c.Expect(f.Format(new(message.Message)), gs.Equals,
+				"LEEF:1.0|Lancope|StealthWatch|1.0||")
+		})
+	})
+
+	c.Specify("A LEEF 2.0 formatter", func() {
+		conf.Version = LEEF_VERSION_2
+
+		c.Specify("uses a configured delimiter", func() {
+			for _, delim := range []string{"^", "x5E", "0x5e"} {
+				conf.Delimiter = delim
+				f, err := NewLeefFormatter(conf)
+				c.Assume(err, gs.IsNil)
+				c.Expect(f.Format(msg), gs.Equals,
+					"LEEF:2.0|Lancope|StealthWatch|1.0|41|^|dst=198.51.100.2^src=192.0.2.1")
+			}
+		})
+
+		c.Specify("escapes the delimiter in values", func() {
+			conf.Delimiter = "^"
+			f, err := NewLeefFormatter(conf)
+			c.Assume(err, gs.IsNil)
+			msg = newCefTestMessage(map[string]interface{}{"detail": "2^10"})
+			c.Expect(f.Format(msg), gs.Equals,
+				`LEEF:2.0|Lancope|StealthWatch|1.0||^|msg=2\^10`)
+		})
+
+		c.Specify("gives unprintable delimiters in hex", func() {
+			f, err := NewLeefFormatter(conf)
+			c.Assume(err, gs.IsNil)
+			c.Expect(f.Format(msg), gs.Equals,
+				"LEEF:2.0|Lancope|StealthWatch|1.0|41|x09|dst=198.51.100.2\tsrc=192.0.2.1")
+		})
+
+		c.Specify("rejects invalid delimiters", func() {
+			for _, delim := range []string{"|", "=", "ab", "xZZ", "x7C"} {
+				conf.Delimiter = delim
+				_, err := NewLeefFormatter(conf)
+				c.Expect(err.Error(), gs.Equals, "invalid LEEF delimiter: "+delim)
+			}
+		})
+	})
+
+	c.Specify("rejects custom delimiters for LEEF 1.0", func() {
+		conf.Delimiter = "^"
+		_, err := NewLeefFormatter(conf)
+		c.Expect(err.Error(), gs.Equals, "LEEF 1.0 only supports tab delimiters")
+	})
+
+	c.Specify("rejects unknown versions", func() {
+		conf.Version = "3.0"
+		_, err := NewLeefFormatter(conf)
+		c.Expect(err.Error(), gs.Equals, "unknown LEEF version: 3.0")
+	})
+
+	c.Specify("rejects unknown header fields", func() {
+		conf.HeaderFields = map[string]string{"severity": "sev"}
+		_, err := NewLeefFormatter(conf)
+		c.Expect(err.Error(), gs.Equals, "unknown LEEF header field: severity")
+	})
+}
@@ -15,8 +15,16 @@
 package heka_mozsvc_plugins
 
 import (
+	"errors"
+	"fmt"
 	"log/syslog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
@@ -44,6 +52,21 @@ var (
 	}
 )
 
+var (
+	// Syslog priorities for Heka severities, which use the syslog
+	// severity levels.
+	DEFAULT_SEVERITY_MAP = map[string]string{
+		"0": "EMERG",
+		"1": "ALERT",
+		"2": "CRIT",
+		"3": "ERR",
+		"4": "WARNING",
+		"5": "NOTICE",
+		"6": "INFO",
+		"7": "DEBUG",
+	}
+)
+
 var (
 	SYSLOG_PRIORITY = map[string]syslog.Priority{
 		"EMERG":   syslog.LOG_EMERG,
@@ -58,82 +81,443 @@ var (
 )
 
 type SyslogMsg struct {
-	priority syslog.Priority
-	prefix   string
-	payload  string
+	priority       syslog.Priority
+	prefix         string
+	payload        string
+	msgId          string
+	structuredData []SyslogSDElement
+	hostname       string
+	timestamp      time.Time
+	// Only set on parsed messages, the writer always sends its own pid
+	// and format.
+	pid    int
+	format string
 }
 
 type CefOutput struct {
 	syslogWriter *SyslogWriter
 	syslogMsg    *SyslogMsg
+	sdIds        []string
+	sdFields     map[string][]string
+	// Renders CEF or LEEF records from message fields, unless the payload
+	// is sent as is.
+	formatter EventFormatter
+	// Take the hostname and timestamp from the Heka message.
+	useMsgHostname  bool
+	useMsgTimestamp bool
+	// Syslog metadata for messages without cef_meta fields.
+	facility    syslog.Priority
+	priority    syslog.Priority
+	ident       string
+	severityMap map[int32]syslog.Priority
+	unknownMeta int64
+	// RFC 5424 MSGID, and the field it's taken from when present.
+	msgId      string
+	msgIdField string
 }
 
 type CefOutputConfig struct {
+	// Blank for the local syslog daemon, or one of "tcp", "udp", "unix",
+	// "unixgram" or "tls".
 	Network string `toml:"network"`
 	Raddr   string `toml:"raddr"`
+	// Several remote addresses, used instead of Raddr.
+	Raddrs []string `toml:"raddrs"`
+	// How messages are spread over Raddrs, one of "failover",
+	// "round-robin" or "fan-out".
+	Mode string `toml:"mode"`
+	// Sockets probed for the local syslog daemon when Network is blank,
+	// and their types, "unixgram" or "unix". Paths starting with "@" are
+	// Linux abstract sockets.
+	LocalPaths []string `toml:"local_paths"`
+	LocalTypes []string `toml:"local_types"`
+	// TLS settings for the "tls" network.
+	Tls TlsConfig `toml:"tls"`
+	// Syslog wire format, one of "legacy", "rfc3164" or "rfc5424".
+	Format string `toml:"format"`
+	// Fixed hostname to send instead of the local machine's.
+	Hostname string `toml:"hostname"`
+	// Send the Heka message's Hostname and Timestamp instead of the local
+	// hostname and the time of the write.
+	UseMessageHostname  bool `toml:"use_message_hostname"`
+	UseMessageTimestamp bool `toml:"use_message_timestamp"`
+	// Precision of legacy and rfc5424 timestamps, one of "s", "ms" or
+	// "us".
+	TimestampPrecision string `toml:"timestamp_precision"`
+	// Framing for stream networks, "newline" or "octet-counting".
+	Framing string `toml:"framing"`
+	// Handling of newlines embedded in messages with newline framing, one
+	// of "keep", "escape" or "strip".
+	EmbeddedNewlines string `toml:"embedded_newlines"`
+	// Size of the queue used to send messages from a separate goroutine,
+	// so a slow collector doesn't stall the output. Zero, the default,
+	// sends synchronously.
+	QueueSize int `toml:"queue_size"`
+	// Maximum size of a syslog message, in bytes. Zero, the default, uses
+	// 2048 for UDP and 8192 for everything else, a negative value means no
+	// limit.
+	MaxMessageSize int `toml:"max_message_size"`
+	// What to do with longer messages, one of "truncate", "fragment" or
+	// "reject".
+	OversizePolicy string `toml:"oversize_policy"`
+	// Handling of invalid UTF-8 in payloads and SD-PARAM values, one of
+	// "keep", "replace" or "escape".
+	InvalidUtf8 string `toml:"invalid_utf8"`
+	// Handling of control characters other than tab, CR and LF, one of
+	// "keep", "escape" or "strip".
+	ControlChars string `toml:"control_chars"`
+	// Start UTF-8 payloads with a BOM, as RFC 5424 requires. Requires the
+	// rfc5424 format.
+	Utf8Bom bool `toml:"utf8_bom"`
+	// What to do when the queue is full, one of "block", "drop-oldest" or
+	// "drop-newest".
+	QueueFullPolicy string `toml:"queue_full_policy"`
+	// Bounds of the exponential backoff before reconnecting to a
+	// collector, as duration strings.
+	ReconnectBackoffMin string `toml:"reconnect_backoff_min"`
+	ReconnectBackoffMax string `toml:"reconnect_backoff_max"`
+	// Connection timeout, as a duration string. A negative duration means
+	// no timeout.
+	DialTimeout string `toml:"dial_timeout"`
+	// TCP keepalive period, as a duration string. Unset uses the Go
+	// default, a negative duration disables keepalives.
+	KeepAlivePeriod string `toml:"keepalive_period"`
+	// Deadline for each write, as a duration string. Unset means no
+	// deadline.
+	WriteTimeout string `toml:"write_timeout"`
+	// Connections that have been idle this long are replaced before the
+	// next write, as a duration string. Unset means never.
+	IdleRefresh string `toml:"idle_refresh"`
+	// Syslog facility, priority and ident for messages that don't set them
+	// with cef_meta fields.
+	Facility string `toml:"facility"`
+	Priority string `toml:"priority"`
+	Ident    string `toml:"ident"`
+	// Derive the priority of messages without a cef_meta.syslog_priority
+	// field from their Severity, using SeverityMap.
+	UseMessageSeverity bool `toml:"use_message_severity"`
+	// Map of Heka severities to syslog priority names. Defaults to
+	// DEFAULT_SEVERITY_MAP.
+	SeverityMap map[string]string `toml:"severity_map"`
+	// How the syslog message body is built, "payload" to send the message
+	// payload as is, or "cef" or "leef" to render a CEF or LEEF record
+	// from message fields.
+	EventFormat string `toml:"event_format"`
+	// CEF header and extension settings for the "cef" event format.
+	Cef CefConfig `toml:"cef"`
+	// LEEF header and attribute settings for the "leef" event format.
+	Leef LeefConfig `toml:"leef"`
+	// Map of RFC 5424 SD-IDs to the names of the message fields that
+	// should be sent as that element's SD-PARAMs. Requires the rfc5424
+	// format.
+	StructuredData map[string][]string `toml:"structured_data"`
+	// RFC 5424 MSGID of every message, and the message field that sets it
+	// instead when present. Require the rfc5424 format.
+	MsgId      string `toml:"msgid"`
+	MsgIdField string `toml:"msgid_field"`
 }
 
 func (cef *CefOutput) ConfigStruct() interface{} {
-	return new(CefOutputConfig)
+	severityMap := make(map[string]string, len(DEFAULT_SEVERITY_MAP))
+	for sev, pri := range DEFAULT_SEVERITY_MAP {
+		severityMap[sev] = pri
+	}
+	return &CefOutputConfig{
+		Format:      SYSLOG_FORMAT_LEGACY,
+		Facility:    "LOCAL4",
+		Priority:    "INFO",
+		Ident:       "heka_no_ident",
+		SeverityMap: severityMap,
+		EventFormat: CEF_EVENT_FORMAT_PAYLOAD,
+		Cef: CefConfig{
+			DeviceVendor:  "Mozilla",
+			DeviceProduct: "Heka",
+			Severity:      "Unknown",
+		},
+		Leef: LeefConfig{
+			Version: LEEF_VERSION_2,
+			Vendor:  "Mozilla",
+			Product: "Heka",
+		},
+		TimestampPrecision:  SYSLOG_TIMESTAMP_SECONDS,
+		OversizePolicy:      SYSLOG_OVERSIZE_TRUNCATE,
+		InvalidUtf8:         SYSLOG_UTF8_KEEP,
+		ControlChars:        SYSLOG_CONTROL_KEEP,
+		Mode:                SYSLOG_MODE_FAILOVER,
+		QueueFullPolicy:     SYSLOG_QUEUE_BLOCK,
+		ReconnectBackoffMin: SYSLOG_BACKOFF_MIN.String(),
+		ReconnectBackoffMax: SYSLOG_BACKOFF_MAX.String(),
+		DialTimeout:         SYSLOG_DIAL_TIMEOUT.String(),
+	}
 }
 
 func (cef *CefOutput) Init(config interface{}) (err error) {
 	conf := config.(*CefOutputConfig)
-	cef.syslogWriter, err = SyslogDial(conf.Network, conf.Raddr)
+	if len(conf.StructuredData) > 0 && conf.Format != SYSLOG_FORMAT_RFC5424 {
+		return errors.New("CefOutput structured_data requires the rfc5424 format")
+	}
+	if (conf.MsgId != "" || conf.MsgIdField != "") && conf.Format != SYSLOG_FORMAT_RFC5424 {
+		return errors.New("CefOutput msgid requires the rfc5424 format")
+	}
+	cef.msgId = conf.MsgId
+	cef.msgIdField = conf.MsgIdField
+	var ok bool
+	if cef.facility, ok = SYSLOG_FACILITY[strings.ToUpper(conf.Facility)]; !ok {
+		return fmt.Errorf("CefOutput unknown facility: %s", conf.Facility)
+	}
+	if cef.priority, ok = SYSLOG_PRIORITY[strings.ToUpper(conf.Priority)]; !ok {
+		return fmt.Errorf("CefOutput unknown priority: %s", conf.Priority)
+	}
+	cef.ident = conf.Ident
+	cef.severityMap = nil
+	if conf.UseMessageSeverity {
+		cef.severityMap = make(map[int32]syslog.Priority)
+		for sevStr, priStr := range conf.SeverityMap {
+			sev, e := strconv.ParseInt(sevStr, 10, 32)
+			if e != nil {
+				return fmt.Errorf("CefOutput invalid severity_map severity: %s", sevStr)
+			}
+			if cef.severityMap[int32(sev)], ok = SYSLOG_PRIORITY[strings.ToUpper(priStr)]; !ok {
+				return fmt.Errorf("CefOutput unknown severity_map priority: %s", priStr)
+			}
+		}
+	}
+
+	cef.sdFields = conf.StructuredData
+	cef.sdIds = make([]string, 0, len(conf.StructuredData))
+	for id := range conf.StructuredData {
+		cef.sdIds = append(cef.sdIds, id)
+	}
+	sort.Strings(cef.sdIds)
+	switch conf.EventFormat {
+	case "", CEF_EVENT_FORMAT_PAYLOAD:
+		cef.formatter = nil
+	case CEF_EVENT_FORMAT_CEF:
+		if cef.formatter, err = NewCefFormatter(&conf.Cef); err != nil {
+			return
+		}
+	case CEF_EVENT_FORMAT_LEEF:
+		if cef.formatter, err = NewLeefFormatter(&conf.Leef); err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("CefOutput unknown event_format: %s", conf.EventFormat)
+	}
+	cef.useMsgHostname = conf.UseMessageHostname
+	cef.useMsgTimestamp = conf.UseMessageTimestamp
+
+	writerConf := &SyslogWriterConfig{
+		Network:            conf.Network,
+		Raddr:              conf.Raddr,
+		Raddrs:             conf.Raddrs,
+		Mode:               conf.Mode,
+		LocalPaths:         conf.LocalPaths,
+		LocalTypes:         conf.LocalTypes,
+		Format:             conf.Format,
+		Hostname:           conf.Hostname,
+		TimestampPrecision: conf.TimestampPrecision,
+		Framing:            conf.Framing,
+		Newlines:           conf.EmbeddedNewlines,
+		QueueSize:          conf.QueueSize,
+		QueueFullPolicy:    conf.QueueFullPolicy,
+		MaxMessageSize:     conf.MaxMessageSize,
+		OversizePolicy:     conf.OversizePolicy,
+		InvalidUtf8:        conf.InvalidUtf8,
+		ControlChars:       conf.ControlChars,
+		Utf8Bom:            conf.Utf8Bom,
+	}
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"reconnect_backoff_min", conf.ReconnectBackoffMin, &writerConf.BackoffMin},
+		{"reconnect_backoff_max", conf.ReconnectBackoffMax, &writerConf.BackoffMax},
+		{"dial_timeout", conf.DialTimeout, &writerConf.DialTimeout},
+		{"keepalive_period", conf.KeepAlivePeriod, &writerConf.KeepAlive},
+		{"write_timeout", conf.WriteTimeout, &writerConf.WriteTimeout},
+		{"idle_refresh", conf.IdleRefresh, &writerConf.IdleRefresh},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if *d.dest, err = time.ParseDuration(d.value); err != nil {
+			return fmt.Errorf("CefOutput invalid %s '%s': %s", d.name, d.value, err)
+		}
+	}
+	if strings.ToLower(conf.Network) == "tls" {
+		if writerConf.TlsConfig, err = CreateGoTlsConfig(&conf.Tls); err != nil {
+			return
+		}
+	}
+	cef.syslogWriter, err = NewSyslogWriter(writerConf)
+	return
+}
+
+// structuredData builds the configured SD-ELEMENTs from the message's
+// fields. Elements without any matching fields are left out.
+func (cef *CefOutput) structuredData(pack *pipeline.PipelinePack) (
+	elements []SyslogSDElement) {
+
+	for _, id := range cef.sdIds {
+		elem := SyslogSDElement{Id: id}
+		for _, name := range cef.sdFields[id] {
+			for _, field := range pack.Message.FindAllFields(name) {
+				for _, value := range fieldValueStrings(field) {
+					elem.Params = append(elem.Params, SyslogSDParam{name, value})
+				}
+			}
+		}
+		if len(elem.Params) > 0 {
+			elements = append(elements, elem)
+		}
+	}
+	return
+}
+
+// fieldValueStrings returns all of a message field's values as strings.
+func fieldValueStrings(field *message.Field) (values []string) {
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		values = append(values, field.GetValueString()...)
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			values = append(values, string(v))
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, strconv.FormatInt(v, 10))
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, strconv.FormatBool(v))
+		}
+	}
 	return
 }
 
+func (cef *CefOutput) ReportMsg(msg *message.Message) error {
+	stats := cef.syslogWriter.Stats()
+	message.NewIntField(msg, "QueueDepth", stats.QueueDepth, "count")
+	message.NewInt64Field(msg, "DroppedMessages", stats.Dropped, "count")
+	message.NewInt64Field(msg, "FailedWrites", stats.Failed, "count")
+	message.NewInt64Field(msg, "ReconnectAttempts", stats.ReconnectAttempts, "count")
+	message.NewInt64Field(msg, "OversizedMessages", stats.Oversized, "count")
+	message.NewStringField(msg, "LastError", stats.LastError)
+	message.NewInt64Field(msg, "UnknownMetaValues", atomic.LoadInt64(&cef.unknownMeta),
+		"count")
+	return nil
+}
+
+// syslogMeta resolves a message's syslog priority, including the facility,
+// and ident. The cef_meta fields take precedence over the message's
+// Severity, if that is used, and the configured defaults. Unknown cef_meta
+// values are logged and counted, and the defaults used instead.
+func (cef *CefOutput) syslogMeta(msg *message.Message, or pipeline.OutputRunner) (
+	priority syslog.Priority, ident string) {
+
+	facility, severity := cef.facility, cef.priority
+	if p, ok := cef.severityMap[msg.GetSeverity()]; ok {
+		severity = p
+	}
+	if v, ok := firstFieldValue(msg, "cef_meta.syslog_priority"); ok {
+		if p, ok := SYSLOG_PRIORITY[strings.ToUpper(v)]; ok {
+			severity = p
+		} else {
+			cef.reportUnknownMeta(or, "cef_meta.syslog_priority", v)
+		}
+	}
+	if v, ok := firstFieldValue(msg, "cef_meta.syslog_facility"); ok {
+		if p, ok := SYSLOG_FACILITY[strings.ToUpper(v)]; ok {
+			facility = p
+		} else {
+			cef.reportUnknownMeta(or, "cef_meta.syslog_facility", v)
+		}
+	}
+	ident = cef.ident
+	if v, ok := firstFieldValue(msg, "cef_meta.syslog_ident"); ok {
+		ident = v
+	}
+	return facility | severity, ident
+}
+
+func (cef *CefOutput) reportUnknownMeta(or pipeline.OutputRunner, name, value string) {
+	atomic.AddInt64(&cef.unknownMeta, 1)
+	or.LogError(fmt.Errorf("unknown %s value '%s', using the default", name, value))
+}
+
 func (cef *CefOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
 
 	var (
-		facility, priority syslog.Priority
-		ident              string
-		ok                 bool
-		p                  syslog.Priority
-		e                  error
-		pack               *pipeline.PipelinePack
+		e        error
+		pack     *pipeline.PipelinePack
+		contents []byte
 	)
+
+	useEncoder := or.Encoder() != nil
+	if useEncoder && cef.formatter != nil {
+		cef.syslogWriter.Close()
+		return errors.New("CefOutput can't use an encoder with the cef or leef event_format")
+	}
 	syslogMsg := new(SyslogMsg)
 	for pack = range or.InChan() {
-
-		// default values
-		facility, priority = syslog.LOG_LOCAL4, syslog.LOG_INFO
-		ident = "heka_no_ident"
-
-		priField := pack.Message.FindFirstField("cef_meta.syslog_priority")
-		if priField != nil {
-			priStr := priField.ValueString[0]
-			if p, ok = SYSLOG_PRIORITY[priStr]; ok {
-				priority = p
+		if useEncoder {
+			if contents, e = or.Encode(pack); e != nil {
+				or.UpdateCursor(pack.QueueCursor)
+				pack.Recycle(fmt.Errorf("Error encoding message: %s", e))
+				continue
 			}
-		}
-
-		facField := pack.Message.FindFirstField("cef_meta.syslog_facility")
-		if facField != nil {
-			facStr := facField.ValueString[0]
-			if p, ok = SYSLOG_FACILITY[facStr]; ok {
-				facility = p
+			if contents == nil {
+				// The encoder chose to skip this message.
+				or.UpdateCursor(pack.QueueCursor)
+				pack.Recycle(nil)
+				continue
 			}
 		}
 
-		idField := pack.Message.FindFirstField("cef_meta.syslog_ident")
-		if idField != nil {
-			ident = idField.ValueString[0]
+		syslogMsg.priority, syslogMsg.prefix = cef.syslogMeta(pack.Message, or)
+		switch {
+		case useEncoder:
+			// Syslog messages are single lines, so the newline most
+			// encoders append is dropped.
+			syslogMsg.payload = strings.TrimSuffix(string(contents), "\n")
+		case cef.formatter != nil:
+			syslogMsg.payload = cef.formatter.Format(pack.Message)
+		default:
+			syslogMsg.payload = pack.Message.GetPayload()
+		}
+		syslogMsg.structuredData = cef.structuredData(pack)
+		syslogMsg.msgId = cef.msgId
+		if v, ok := firstFieldValue(pack.Message, cef.msgIdField); ok {
+			syslogMsg.msgId = v
+		}
+		if cef.useMsgHostname {
+			syslogMsg.hostname = pack.Message.GetHostname()
+		}
+		syslogMsg.timestamp = time.Time{}
+		if cef.useMsgTimestamp && pack.Message.GetTimestamp() != 0 {
+			syslogMsg.timestamp = time.Unix(0, pack.Message.GetTimestamp())
 		}
 
-		syslogMsg.priority = priority | facility
-		syslogMsg.prefix = ident
-		syslogMsg.payload = pack.Message.GetPayload()
-
-		_, e = cef.syslogWriter.WriteString(syslogMsg.priority, syslogMsg.prefix,
-			syslogMsg.payload)
+		_, e = cef.syslogWriter.WriteMsg(syslogMsg)
 
-		if e != nil {
-			e = pipeline.NewRetryMessageError("can't write to syslog: %s", e.Error())
-			pack.Recycle(e)
-		} else {
+		switch e.(type) {
+		case nil:
 			or.UpdateCursor(pack.QueueCursor)
 			pack.Recycle(nil)
+		case *SyslogOversizeError, *SyslogPartialWriteError:
+			// Retrying won't make the message fit, and would send the
+			// fragments already written again.
+			or.UpdateCursor(pack.QueueCursor)
+			pack.Recycle(fmt.Errorf("Error writing message: %s", e))
+		default:
+			e = pipeline.NewRetryMessageError("can't write to syslog: %s", e.Error())
+			pack.Recycle(e)
 		}
 	}
 
@@ -16,97 +16,478 @@
 package heka_mozsvc_plugins
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/crankycoder/g2s"
+	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 )
 
-// Interface that all statsd clients must implement.
+const (
+	// Tag values are sent as DogStatsD `|#key:value` tags.
+	STATSD_TAGS_DOGSTATSD = "dogstatsd"
+	// Tag values are appended to the bucket name, for plain statsd
+	// servers.
+	STATSD_TAGS_DOTTED = "dotted"
+)
+
+const (
+	// Characters that aren't valid in bucket names are replaced with the
+	// bucket_replacement string.
+	STATSD_BUCKET_REPLACE = "replace"
+	// Invalid characters are removed.
+	STATSD_BUCKET_STRIP = "strip"
+	// Bucket names are sent as they are.
+	STATSD_BUCKET_KEEP = "keep"
+)
+
+// Milliseconds per unit of the timer message "unit" field. Timers without
+// one are in milliseconds.
+var STATSD_TIMER_UNITS = map[string]float64{
+	"us": 0.001,
+	"ms": 1,
+	"s":  1000,
+}
+
+// Interface that all statsd clients must implement. Tags are DogStatsD
+// `key:value` tags.
 type StatsdClient interface {
-	IncrementCounter(bucket string, n int)
-	IncrementSampledCounter(bucket string, n int, srate float32)
-	SendTiming(bucket string, ms int)
-	SendSampledTiming(bucket string, ms int, srate float32)
+	IncrementCounter(bucket string, n int64, tags ...string)
+	IncrementSampledCounter(bucket string, n int64, srate float32, tags ...string)
+	SendTiming(bucket string, ms float64, tags ...string)
+	SendSampledTiming(bucket string, ms float64, srate float32, tags ...string)
+	SetGauge(bucket string, value float64, tags ...string)
+	AdjustGauge(bucket string, delta float64, tags ...string)
+	AddToSet(bucket string, member string, tags ...string)
+	SendHistogram(bucket string, value float64, tags ...string)
+	SendSampledHistogram(bucket string, value float64, srate float32, tags ...string)
 }
 
 type StatsdMsg struct {
 	msgType string
 	key     string
-	value   int
-	rate    float32
+	// The value of timers, in milliseconds, gauges and histograms.
+	value float64
+	// The value of counters, which are whole numbers.
+	count int64
+	rate  float32
+	// Set for gauge payloads starting with a sign, which adjust the gauge
+	// rather than set it.
+	delta bool
+	// The payload of set messages, which isn't a number.
+	member string
+	// Comma separated DogStatsD tags.
+	tags string
 }
 
 type StatsdOutput struct {
 	statsdClient StatsdClient
 	statsdMsg    *StatsdMsg
 	err          error
+	tagFields    []string
+	tagMode      string
+	nameField    string
+	nameTemplate string
+	prefix       string
+	suffix       string
+	invalidChars string
+	replacement  string
+	valueField   string
+	rateField    string
+	typeField    string
+	metricType   string
 }
 
 type StatsdOutputConfig struct {
+	// host:port of the statsd server, sent to over UDP, or a URL naming
+	// the transport: "udp://host:port", "tcp://host:port" or
+	// "unixgram:///path/to/socket".
 	Url string
+	// Several statsd servers, given like Url, to spread buckets over by
+	// consistent hashing instead of using Url.
+	Urls []string `toml:"urls"`
+	// Message headers, such as Hostname or Logger, and fields whose values
+	// tag each metric.
+	TagFields []string `toml:"tag_fields"`
+	// How tags are sent, "dogstatsd" or "dotted".
+	TagMode string `toml:"tag_mode"`
+	// How long metrics are buffered and packed together before they're
+	// sent, as a duration string. Unset sends every metric right away.
+	FlushInterval string `toml:"flush_interval"`
+	// Largest packet holding buffered metrics, in bytes.
+	MaxPacketSize int `toml:"max_packet_size"`
+	// Sum counters and combine gauge updates over each flush interval.
+	Aggregate bool `toml:"aggregate"`
+	// Bounds of the delay before reconnecting, as duration strings.
+	ReconnectBackoffMin string `toml:"reconnect_backoff_min"`
+	ReconnectBackoffMax string `toml:"reconnect_backoff_max"`
+	// How long a write may block before the metric is dropped, as a
+	// duration string.
+	WriteTimeout string `toml:"write_timeout"`
+	// Header or field holding the bucket name, which is prefixed with the
+	// Logger.
+	NameField string `toml:"name_field"`
+	// Builds the bucket name from %{name} references to headers and
+	// fields instead, overriding NameField.
+	NameTemplate string `toml:"name_template"`
+	// Header or field holding the metric value.
+	ValueField string `toml:"value_field"`
+	// Field holding the sample rate. Metrics without one have a rate of 1.
+	RateField string `toml:"rate_field"`
+	// Header or field holding the metric type.
+	TypeField string `toml:"type_field"`
+	// Sends every message as this metric type, overriding TypeField.
+	MetricType string `toml:"metric_type"`
+	// Added before and after every bucket name. They may hold %{name}
+	// references, like NameTemplate.
+	BucketPrefix string `toml:"bucket_prefix"`
+	BucketSuffix string `toml:"bucket_suffix"`
+	// How characters that aren't valid in bucket names are handled,
+	// "replace", "strip" or "keep".
+	InvalidBucketChars string `toml:"invalid_bucket_chars"`
+	// What invalid characters are replaced with.
+	BucketReplacement string `toml:"bucket_replacement"`
 }
 
 func (so *StatsdOutput) ConfigStruct() interface{} {
 	// Default the statsd output to localhost port 5555
-	return &StatsdOutputConfig{Url: "localhost:5555"}
+	return &StatsdOutputConfig{
+		Url:                 "localhost:5555",
+		TagMode:             STATSD_TAGS_DOGSTATSD,
+		MaxPacketSize:       STATSD_MAX_PACKET_SIZE,
+		ReconnectBackoffMin: STATSD_BACKOFF_MIN.String(),
+		ReconnectBackoffMax: STATSD_BACKOFF_MAX.String(),
+		WriteTimeout:        STATSD_WRITE_TIMEOUT.String(),
+		NameField:           "name",
+		ValueField:          "Payload",
+		RateField:           "rate",
+		TypeField:           "Type",
+		InvalidBucketChars:  STATSD_BUCKET_REPLACE,
+		BucketReplacement:   "_",
+	}
 }
 
 func (so *StatsdOutput) Init(config interface{}) (err error) {
 	conf := config.(*StatsdOutputConfig)
-	so.statsdClient, err = g2s.NewStatsd(conf.Url, 0)
+	switch conf.TagMode {
+	case "", STATSD_TAGS_DOGSTATSD:
+		so.tagMode = STATSD_TAGS_DOGSTATSD
+	case STATSD_TAGS_DOTTED:
+		so.tagMode = STATSD_TAGS_DOTTED
+	default:
+		return fmt.Errorf("StatsdOutput unknown tag_mode: %s", conf.TagMode)
+	}
+	so.tagFields = conf.TagFields
+
+	switch conf.MetricType {
+	case "", "counter", "timer", "gauge", "set", "histogram":
+	default:
+		return fmt.Errorf("StatsdOutput unknown metric_type: %s", conf.MetricType)
+	}
+	if conf.NameField == "" && conf.NameTemplate == "" {
+		return errors.New("StatsdOutput requires a name_field or name_template")
+	}
+	if conf.ValueField == "" {
+		return errors.New("StatsdOutput requires a value_field")
+	}
+	if conf.TypeField == "" && conf.MetricType == "" {
+		return errors.New("StatsdOutput requires a type_field or metric_type")
+	}
+	so.nameField = conf.NameField
+	so.nameTemplate = conf.NameTemplate
+	so.valueField = conf.ValueField
+	so.rateField = conf.RateField
+	so.typeField = conf.TypeField
+	so.metricType = conf.MetricType
+
+	switch conf.InvalidBucketChars {
+	case STATSD_BUCKET_REPLACE:
+		if sanitizeStatsdBucket(conf.BucketReplacement, STATSD_BUCKET_STRIP, "") !=
+			conf.BucketReplacement {
+
+			return errors.New("StatsdOutput bucket_replacement holds invalid characters")
+		}
+	case STATSD_BUCKET_STRIP, STATSD_BUCKET_KEEP:
+	default:
+		return fmt.Errorf("StatsdOutput unknown invalid_bucket_chars handling: %s",
+			conf.InvalidBucketChars)
+	}
+	so.prefix = conf.BucketPrefix
+	so.suffix = conf.BucketSuffix
+	so.invalidChars = conf.InvalidBucketChars
+	so.replacement = conf.BucketReplacement
+
+	clientConf := &StatsdClientConfig{
+		MaxPacketSize: conf.MaxPacketSize,
+		Aggregate:     conf.Aggregate,
+	}
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"flush_interval", conf.FlushInterval, &clientConf.FlushInterval},
+		{"reconnect_backoff_min", conf.ReconnectBackoffMin, &clientConf.BackoffMin},
+		{"reconnect_backoff_max", conf.ReconnectBackoffMax, &clientConf.BackoffMax},
+		{"write_timeout", conf.WriteTimeout, &clientConf.WriteTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if *d.dest, err = time.ParseDuration(d.value); err != nil {
+			return fmt.Errorf("StatsdOutput invalid %s '%s': %s", d.name, d.value, err)
+		}
+	}
+	if conf.Aggregate && clientConf.FlushInterval <= 0 {
+		return errors.New("StatsdOutput aggregate requires a flush_interval")
+	}
+
+	if len(conf.Urls) == 0 {
+		if clientConf.Network, clientConf.Addr, err = parseStatsdUrl(conf.Url); err != nil {
+			return
+		}
+		so.statsdClient, err = NewStatsdNetClient(clientConf)
+		return
+	}
+	// Each server is known on the ring by its url, so the routing doesn't
+	// depend on the order they're listed in.
+	confs := make(map[string]*StatsdClientConfig, len(conf.Urls))
+	for _, url := range conf.Urls {
+		if _, ok := confs[url]; ok {
+			return fmt.Errorf("StatsdOutput url listed twice: %s", url)
+		}
+		serverConf := *clientConf
+		if serverConf.Network, serverConf.Addr, err = parseStatsdUrl(url); err != nil {
+			return
+		}
+		confs[url] = &serverConf
+	}
+	so.statsdClient, err = NewStatsdClusterClient(confs)
+	return
+}
+
+// parseStatsdUrl splits a statsd URL into a network and address. URLs
+// without a scheme are host:port pairs for UDP.
+func parseStatsdUrl(url string) (network, addr string, err error) {
+	i := strings.Index(url, "://")
+	if i < 0 {
+		return "udp", url, nil
+	}
+	network, addr = url[:i], url[i+3:]
+	switch network {
+	case "udp", "tcp", "unixgram":
+	default:
+		return "", "", fmt.Errorf("StatsdOutput unknown url scheme: %s", network)
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("StatsdOutput url has no address: %s", url)
+	}
 	return
 }
 
 func (so *StatsdOutput) prepStatsdMsg(pack *pipeline.PipelinePack,
 	statsdMsg *StatsdMsg) (err error) {
 
-	// we need the ns for the full key
-	ns := pack.Message.GetLogger()
-
-	var tmp interface{}
+	var key, prefix, suffix string
 	var ok bool
-	var key string
-	var rate64 float64
-
-	if tmp, ok = pack.Message.GetFieldValue("name"); !ok {
-		return errors.New("statsd message missing stat name")
+	if so.nameTemplate != "" {
+		if key, err = renderStatsdTemplate(so.nameTemplate, "name_template",
+			pack.Message); err != nil {
+			return
+		}
+	} else {
+		if key, ok = statsdFieldValue(pack.Message, so.nameField); !ok || key == "" {
+			return errors.New("statsd message missing stat name")
+		}
+		// we need the ns for the full key
+		if ns := pack.Message.GetLogger(); strings.TrimSpace(ns) != "" {
+			key = ns + "." + key
+		}
+	}
+	if prefix, err = renderStatsdTemplate(so.prefix, "bucket_prefix",
+		pack.Message); err != nil {
+		return
 	}
-	if key, ok = tmp.(string); !ok {
-		return errors.New("statsd message stat name is not a string")
+	if suffix, err = renderStatsdTemplate(so.suffix, "bucket_suffix",
+		pack.Message); err != nil {
+		return
+	}
+	key = sanitizeStatsdBucket(prefix+key+suffix, so.invalidChars, so.replacement)
+	if key == "" {
+		return errors.New("statsd message bucket name is empty")
 	}
 
-	if strings.TrimSpace(ns) != "" {
-		s := []string{ns, key}
-		key = strings.Join(s, ".")
+	var tags []string
+	for _, name := range so.tagFields {
+		tagValue, _ := statsdFieldValue(pack.Message, name)
+		if tagValue == "" {
+			continue
+		}
+		if so.tagMode == STATSD_TAGS_DOTTED {
+			key += "." + sanitizeStatsdTag(tagValue, ".")
+		} else {
+			tags = append(tags, sanitizeStatsdTag(name, "")+":"+
+				sanitizeStatsdTag(tagValue, ""))
+		}
 	}
 
-	var val64 int64
-	if val64, err = strconv.ParseInt(pack.Message.GetPayload(), 10, 32); err != nil {
-		return fmt.Errorf("can't parse statsd message payload '%s': %s",
-			pack.Message.GetPayload(), err)
+	msgType := so.metricType
+	if msgType == "" {
+		msgType, _ = statsdFieldValue(pack.Message, so.typeField)
+	}
+	var payload string
+	if payload, ok = statsdFieldValue(pack.Message, so.valueField); !ok {
+		return errors.New("statsd message missing value")
+	}
+	var value float64
+	var count int64
+	switch msgType {
+	case "set":
+	case "counter":
+		if count, err = strconv.ParseInt(payload, 10, 64); err != nil {
+			return fmt.Errorf("can't parse statsd message payload '%s': %s",
+				payload, err)
+		}
+	default:
+		if value, err = strconv.ParseFloat(payload, 64); err != nil {
+			return fmt.Errorf("can't parse statsd message payload '%s': %s",
+				payload, err)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("statsd message payload '%s' is not a finite number",
+				payload)
+		}
 	}
-	value := int(val64)
 
-	if tmp, ok = pack.Message.GetFieldValue("rate"); !ok {
-		return errors.New("statsd message missing rate value")
+	if msgType == "timer" {
+		if tmp, ok := pack.Message.GetFieldValue("unit"); ok {
+			unit, _ := tmp.(string)
+			perUnit, ok := STATSD_TIMER_UNITS[unit]
+			if !ok {
+				return fmt.Errorf("unknown statsd timer unit: %v", tmp)
+			}
+			value *= perUnit
+		}
 	}
-	if rate64, ok = tmp.(float64); !ok {
-		return errors.New("statsd message rate is not a float")
+
+	// Metrics without a rate weren't sampled.
+	rate := float32(1)
+	if rateStr, ok := statsdFieldValue(pack.Message, so.rateField); ok {
+		var rate64 float64
+		if rate64, err = strconv.ParseFloat(rateStr, 64); err != nil {
+			return errors.New("statsd message rate is not a float")
+		}
+		if !(rate64 > 0 && rate64 <= 1) {
+			return fmt.Errorf("statsd message rate %s is not in (0, 1]", rateStr)
+		}
+		rate = float32(rate64)
 	}
-	rate := float32(rate64)
 
 	// Set all the statsdMsg attributes
-	statsdMsg.msgType = pack.Message.GetType()
+	statsdMsg.msgType = msgType
 	statsdMsg.key = key
 	statsdMsg.value = value
+	statsdMsg.count = count
 	statsdMsg.rate = rate
+	statsdMsg.delta = msgType == "gauge" &&
+		(strings.HasPrefix(payload, "+") || strings.HasPrefix(payload, "-"))
+	statsdMsg.member = ""
+	if msgType == "set" {
+		statsdMsg.member = payload
+	}
+	statsdMsg.tags = strings.Join(tags, ",")
+	return
+}
+
+// Matches the %{name} references in bucket name templates.
+var statsdTemplateRegexp = regexp.MustCompile(`%\{([^}]*)\}`)
+
+// renderStatsdTemplate fills in a template set by the named option with
+// the message's header and field values, all of which must be present.
+func renderStatsdTemplate(tmpl, option string, msg *message.Message) (
+	s string, err error) {
+
+	s = statsdTemplateRegexp.ReplaceAllStringFunc(tmpl, func(ref string) string {
+		field := ref[2 : len(ref)-1]
+		value, ok := statsdFieldValue(msg, field)
+		if (!ok || value == "") && err == nil {
+			err = fmt.Errorf("statsd message missing %s value: %s", option, field)
+		}
+		return value
+	})
 	return
 }
 
+// statsdFieldValue returns the value of a message header or, for any other
+// name, of the first field with that name. Headers are always present.
+func statsdFieldValue(msg *message.Message, name string) (string, bool) {
+	switch name {
+	case "Hostname":
+		return msg.GetHostname(), true
+	case "Logger":
+		return msg.GetLogger(), true
+	case "Type":
+		return msg.GetType(), true
+	case "Payload":
+		return msg.GetPayload(), true
+	case "EnvVersion":
+		return msg.GetEnvVersion(), true
+	case "Severity":
+		return strconv.Itoa(int(msg.GetSeverity())), true
+	case "Pid":
+		return strconv.Itoa(int(msg.GetPid())), true
+	}
+	return firstFieldValue(msg, name)
+}
+
+// sanitizeStatsdTag replaces everything but letters, digits, '_', '-', '.'
+// and '/' with underscores, along with any characters in invalid. Statsd
+// and DogStatsD use the others as separators.
+func sanitizeStatsdTag(s, invalid string) string {
+	return strings.Map(func(r rune) rune {
+		if validStatsdRune(r) && !strings.ContainsRune(invalid, r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// sanitizeStatsdBucket replaces or strips the characters of a bucket name
+// that validStatsdRune rejects, or keeps them all.
+func sanitizeStatsdBucket(s, invalidChars, replacement string) string {
+	if invalidChars == STATSD_BUCKET_KEEP {
+		return s
+	}
+	var buf bytes.Buffer
+	for _, r := range s {
+		if validStatsdRune(r) {
+			buf.WriteRune(r)
+		} else if invalidChars == STATSD_BUCKET_REPLACE {
+			buf.WriteString(replacement)
+		}
+	}
+	return buf.String()
+}
+
+// validStatsdRune reports whether r is an ASCII letter or digit, '_', '-',
+// '.' or '/'.
+func validStatsdRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+		r == '_', r == '-', r == '.', r == '/':
+		return true
+	}
+	return false
+}
+
 func (so *StatsdOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
 
 	var (
@@ -123,27 +504,50 @@ func (so *StatsdOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (
 			continue
 		}
 
+		var tags []string
+		if statsdMsg.tags != "" {
+			tags = strings.Split(statsdMsg.tags, ",")
+		}
 		switch statsdMsg.msgType {
 		case "counter":
 			if statsdMsg.rate == 1 {
-				so.statsdClient.IncrementCounter(statsdMsg.key, statsdMsg.value)
+				so.statsdClient.IncrementCounter(statsdMsg.key, statsdMsg.count, tags...)
 			} else {
 				so.statsdClient.IncrementSampledCounter(statsdMsg.key,
-					statsdMsg.value, statsdMsg.rate)
+					statsdMsg.count, statsdMsg.rate, tags...)
 			}
 		case "timer":
 			if statsdMsg.rate == 1 {
-				so.statsdClient.SendTiming(statsdMsg.key, statsdMsg.value)
+				so.statsdClient.SendTiming(statsdMsg.key, statsdMsg.value, tags...)
 			} else {
 				so.statsdClient.SendSampledTiming(statsdMsg.key,
-					statsdMsg.value, statsdMsg.rate)
+					statsdMsg.value, statsdMsg.rate, tags...)
+			}
+		case "gauge":
+			if statsdMsg.delta {
+				so.statsdClient.AdjustGauge(statsdMsg.key, statsdMsg.value, tags...)
+			} else {
+				so.statsdClient.SetGauge(statsdMsg.key, statsdMsg.value, tags...)
+			}
+		case "set":
+			so.statsdClient.AddToSet(statsdMsg.key, statsdMsg.member, tags...)
+		case "histogram":
+			if statsdMsg.rate == 1 {
+				so.statsdClient.SendHistogram(statsdMsg.key, statsdMsg.value, tags...)
+			} else {
+				so.statsdClient.SendSampledHistogram(statsdMsg.key,
+					statsdMsg.value, statsdMsg.rate, tags...)
 			}
 		default:
 			or.LogError(fmt.Errorf("unrecognized statsd message type: %s",
-				statsdMsg))
+				statsdMsg.msgType))
 		}
 	}
 
+	// Send whatever the client still holds.
+	if closer, ok := so.statsdClient.(io.Closer); ok {
+		closer.Close()
+	}
 	return
 }
 
@@ -16,12 +16,20 @@
 package heka_mozsvc_plugins
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	ts "github.com/mozilla-services/heka-mozsvc-plugins/testsupport"
 	"github.com/mozilla-services/heka/message"
 	pipeline "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
 	"github.com/rafrombrc/gomock/gomock"
 	gs "github.com/rafrombrc/gospec/src/gospec"
@@ -57,7 +65,7 @@ func StatsdOutputSpec(c gs.Context) {
 
 		decrMsg := &StatsdMsg{msgType: "counter",
 			key:   "thenamespace.myname",
-			value: -1,
+			count: -1,
 			rate:  float32(.30)}
 
 		c.Specify("writes", func() {
@@ -79,7 +87,7 @@ func StatsdOutputSpec(c gs.Context) {
 				c.Expect(*msg, gs.Equals, *decrMsg)
 
 				mockStatsdClient.EXPECT().IncrementSampledCounter("thenamespace.myname",
-					-1, float32(.30))
+					int64(-1), float32(.30))
 				inChan <- pack
 				close(inChan)
 				wg.Add(1)
@@ -100,7 +108,7 @@ func StatsdOutputSpec(c gs.Context) {
 				c.Expect(*msg, gs.Equals, *timerMsg)
 
 				mockStatsdClient.EXPECT().SendSampledTiming("thenamespace.myname",
-					123, float32(.30))
+					float64(123), float32(.30))
 				inChan <- pack
 				close(inChan)
 				wg.Add(1)
@@ -112,6 +120,884 @@ func StatsdOutputSpec(c gs.Context) {
 
 				wg.Wait()
 			})
+
+			run := func(pack *pipeline.PipelinePack) {
+				inChan <- pack
+				close(inChan)
+				wg.Add(1)
+				go func() {
+					output.Run(oth.MockOutputRunner, oth.MockHelper)
+					wg.Done()
+				}()
+				wg.Wait()
+			}
+
+			c.Specify("a gauge msg", func() {
+				mockStatsdClient.EXPECT().SetGauge("thenamespace.myname", float64(42))
+				run(getStatsdPack("gauge", "42"))
+			})
+
+			c.Specify("a gauge delta msg", func() {
+				pack := getStatsdPack("gauge", "-3")
+				msg := new(StatsdMsg)
+				err := output.prepStatsdMsg(pack, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.delta, gs.IsTrue)
+
+				mockStatsdClient.EXPECT().AdjustGauge("thenamespace.myname", float64(-3))
+				run(pack)
+			})
+
+			c.Specify("a set msg", func() {
+				mockStatsdClient.EXPECT().AddToSet("thenamespace.myname", "user-1234")
+				run(getStatsdPack("set", "user-1234"))
+			})
+
+			c.Specify("a histogram msg", func() {
+				mockStatsdClient.EXPECT().SendSampledHistogram("thenamespace.myname",
+					float64(250), float32(.30))
+				run(getStatsdPack("histogram", "250"))
+			})
+
+			c.Specify("a fractional timer msg", func() {
+				mockStatsdClient.EXPECT().SendSampledTiming("thenamespace.myname",
+					12.5, float32(.30))
+				run(getStatsdPack("timer", "12.5"))
+			})
+
+			c.Specify("a counter msg past the int32 range", func() {
+				mockStatsdClient.EXPECT().IncrementSampledCounter("thenamespace.myname",
+					int64(5000000000), float32(.30))
+				run(getStatsdPack("counter", "5000000000"))
+			})
+		})
+
+		c.Specify("tags metrics with message headers and fields", func() {
+			pack := getStatsdPack("counter", "5")
+			pack.Message.SetHostname("web1.example.com")
+			for name, value := range map[string]string{"env": "prod", "service": "auth api|v2"} {
+				f, _ := message.NewField(name, value, "")
+				pack.Message.AddField(f)
+			}
+			config.TagFields = []string{"Hostname", "env", "missing", "service"}
+
+			c.Specify("as DogStatsD tags", func() {
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				msg := new(StatsdMsg)
+				err = output.prepStatsdMsg(pack, msg)
+				c.Assume(err, gs.IsNil)
+				c.Expect(msg.key, gs.Equals, "thenamespace.myname")
+				c.Expect(msg.tags, gs.Equals,
+					"Hostname:web1.example.com,env:prod,service:auth_api_v2")
+
+				mockStatsdClient := ts.NewMockStatsdClient(ctrl)
+				output.statsdClient = mockStatsdClient
+				oth := plugins_ts.NewOutputTestHelper(ctrl)
+				inChan := make(chan *pipeline.PipelinePack, 1)
+				oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+				oth.MockOutputRunner.EXPECT().UpdateCursor("").AnyTimes()
+				mockStatsdClient.EXPECT().IncrementSampledCounter("thenamespace.myname",
+					int64(5), float32(.30), "Hostname:web1.example.com", "env:prod",
+					"service:auth_api_v2")
+				inChan <- pack
+				close(inChan)
+				output.Run(oth.MockOutputRunner, oth.MockHelper)
+			})
+
+			c.Specify("as dotted names", func() {
+				config.TagMode = STATSD_TAGS_DOTTED
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				msg := new(StatsdMsg)
+				err = output.prepStatsdMsg(pack, msg)
+				c.Assume(err, gs.IsNil)
+				c.Expect(msg.key, gs.Equals,
+					"thenamespace.myname.web1_example_com.prod.auth_api_v2")
+				c.Expect(msg.tags, gs.Equals, "")
+			})
+
+			c.Specify("rejecting unknown modes", func() {
+				config.TagMode = "influx"
+				err := output.Init(config)
+				c.Expect(err.Error(), gs.Equals, "StatsdOutput unknown tag_mode: influx")
+			})
+		})
+
+		c.Specify("converts timer units to milliseconds", func() {
+			for unit, exp := range map[string]float64{
+				"us": 1.5,
+				"ms": 1500,
+				"s":  1500000,
+			} {
+				pack := getStatsdPack("timer", "1500")
+				f, _ := message.NewField("unit", unit, "")
+				pack.Message.AddField(f)
+				msg := new(StatsdMsg)
+				err := output.prepStatsdMsg(pack, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.value, gs.Equals, exp)
+			}
+
+			pack := getStatsdPack("timer", "1500")
+			f, _ := message.NewField("unit", "fortnight", "")
+			pack.Message.AddField(f)
+			err := output.prepStatsdMsg(pack, new(StatsdMsg))
+			c.Expect(err.Error(), gs.Equals, "unknown statsd timer unit: fortnight")
+		})
+
+		c.Specify("rejects fractional counters and non-finite values", func() {
+			err := output.prepStatsdMsg(getStatsdPack("counter", "1.5"), new(StatsdMsg))
+			c.Expect(strings.HasPrefix(err.Error(),
+				"can't parse statsd message payload '1.5': "), gs.IsTrue)
+			err = output.prepStatsdMsg(getStatsdPack("gauge", "NaN"), new(StatsdMsg))
+			c.Expect(err.Error(), gs.Equals,
+				"statsd message payload 'NaN' is not a finite number")
+		})
+
+		c.Specify("sanitizes bucket names", func() {
+			tests := []struct {
+				logger string
+				name   string
+				policy string
+				exp    string
+			}{
+				{"app", "requests", STATSD_BUCKET_REPLACE, "app.requests"},
+				{"app:8080", "req|c", STATSD_BUCKET_REPLACE, "app_8080.req_c"},
+				{"app", "x:1|c\ny:2", STATSD_BUCKET_REPLACE, "app.x_1_c_y_2"},
+				{"app", "rate|@0.1|#env:prod", STATSD_BUCKET_REPLACE,
+					"app.rate__0.1__env_prod"},
+				{"my app", "café latency", STATSD_BUCKET_REPLACE, "my_app.caf__latency"},
+				{"app", "\x00\t\r", STATSD_BUCKET_REPLACE, "app.___"},
+				{"app:8080", "req|c", STATSD_BUCKET_STRIP, "app8080.reqc"},
+				{"", "|:@", STATSD_BUCKET_STRIP, ""},
+				{"app:8080", "req|c", STATSD_BUCKET_KEEP, "app:8080.req|c"},
+			}
+			for _, test := range tests {
+				config.InvalidBucketChars = test.policy
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				pack := getStatsdPack("counter", "1")
+				pack.Message.SetLogger(test.logger)
+				pack.Message.Fields[0].ValueString = []string{test.name}
+				msg := new(StatsdMsg)
+				err = output.prepStatsdMsg(pack, msg)
+				if test.exp == "" {
+					c.Expect(err.Error(), gs.Equals, "statsd message bucket name is empty")
+					continue
+				}
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.key, gs.Equals, test.exp)
+			}
+
+			config.InvalidBucketChars = "escape"
+			err := output.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"StatsdOutput unknown invalid_bucket_chars handling: escape")
+
+			config.InvalidBucketChars = STATSD_BUCKET_REPLACE
+			config.BucketReplacement = ":"
+			err = output.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"StatsdOutput bucket_replacement holds invalid characters")
+		})
+
+		c.Specify("adds the bucket prefix and suffix", func() {
+			config.BucketPrefix = "prod.us-west-2.%{Hostname}."
+			config.BucketSuffix = ".%{Type}"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			pack := getStatsdPack("counter", "1")
+			pack.Message.SetHostname("web1:80")
+			msg := new(StatsdMsg)
+			err = output.prepStatsdMsg(pack, msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg.key, gs.Equals, "prod.us-west-2.web1_80.thenamespace.myname.counter")
+
+			config.BucketSuffix = ".%{region}"
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = output.prepStatsdMsg(pack, msg)
+			c.Expect(err.Error(), gs.Equals,
+				"statsd message missing bucket_suffix value: region")
+		})
+
+		c.Specify("defaults to a rate of 1", func() {
+			for _, typ := range []string{"gauge", "set", "counter"} {
+				pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+				pack.Message.SetType(typ)
+				fName, _ := message.NewField("name", "myname", "")
+				pack.Message.AddField(fName)
+				pack.Message.SetPayload("+7")
+				msg := new(StatsdMsg)
+				err := output.prepStatsdMsg(pack, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.rate, gs.Equals, float32(1))
+			}
+
+			pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			pack.Message.SetType("counter")
+			pack.Message.SetPayload("1")
+			for name, value := range map[string]interface{}{"name": "myname", "rate": 1.5} {
+				f, _ := message.NewField(name, value, "")
+				pack.Message.AddField(f)
+			}
+			err := output.prepStatsdMsg(pack, new(StatsdMsg))
+			c.Expect(err.Error(), gs.Equals, "statsd message rate 1.5 is not in (0, 1]")
+		})
+
+		c.Specify("reads metrics from configured fields", func() {
+			pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			pack.Message.SetType("nginx.access")
+			pack.Message.SetLogger("nginx")
+			pack.Message.SetHostname("web1")
+			for name, value := range map[string]interface{}{
+				"metric":       "latency",
+				"request_time": 0.25,
+				"sampling":     "0.5",
+				"kind":         "timer",
+				"status":       int64(200),
+			} {
+				f, _ := message.NewField(name, value, "")
+				pack.Message.AddField(f)
+			}
+			config.NameField = "metric"
+			config.ValueField = "request_time"
+			config.RateField = "sampling"
+			config.TypeField = "kind"
+
+			c.Specify("by field name", func() {
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				msg := new(StatsdMsg)
+				err = output.prepStatsdMsg(pack, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(*msg, gs.Equals, StatsdMsg{msgType: "timer",
+					key: "nginx.latency", value: 0.25, rate: 0.5})
+			})
+
+			c.Specify("with a name template and a fixed type", func() {
+				config.NameTemplate = "%{Hostname}.responses.%{status}"
+				config.MetricType = "histogram"
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				msg := new(StatsdMsg)
+				err = output.prepStatsdMsg(pack, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(*msg, gs.Equals, StatsdMsg{msgType: "histogram",
+					key: "web1.responses.200", value: 0.25, rate: 0.5})
+
+				config.NameTemplate = "%{Hostname}.%{upstream}"
+				err = output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.prepStatsdMsg(pack, new(StatsdMsg))
+				c.Expect(err.Error(), gs.Equals,
+					"statsd message missing name_template value: upstream")
+			})
+
+			c.Specify("failing on missing fields", func() {
+				config.ValueField = "bytes"
+				err := output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.prepStatsdMsg(pack, new(StatsdMsg))
+				c.Expect(err.Error(), gs.Equals, "statsd message missing value")
+
+				config.NameField = "name"
+				err = output.Init(config)
+				c.Assume(err, gs.IsNil)
+				err = output.prepStatsdMsg(pack, new(StatsdMsg))
+				c.Expect(err.Error(), gs.Equals, "statsd message missing stat name")
+			})
+
+			c.Specify("rejecting bad settings", func() {
+				config.MetricType = "meter"
+				err := output.Init(config)
+				c.Expect(err.Error(), gs.Equals, "StatsdOutput unknown metric_type: meter")
+
+				config.MetricType = ""
+				config.TypeField = ""
+				err = output.Init(config)
+				c.Expect(err.Error(), gs.Equals,
+					"StatsdOutput requires a type_field or metric_type")
+			})
+		})
+	})
+
+	c.Specify("A StatsdNetClient", func() {
+		sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		defer sock.Close()
+		conf := &StatsdClientConfig{Addr: sock.LocalAddr().String()}
+
+		receive := func() string {
+			buf := make([]byte, 1024)
+			sock.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := sock.ReadFrom(buf)
+			if err != nil {
+				return err.Error()
+			}
+			return string(buf[:n])
+		}
+
+		c.Specify("writes every metric type", func() {
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			defer client.Close()
+			tests := []struct {
+				send func()
+				exp  string
+			}{
+				{func() { client.IncrementCounter("a", 1) }, "a:1|c"},
+				{func() { client.IncrementSampledCounter("a", -2, .5) }, "a:-2|c|@0.5"},
+				{func() { client.SendTiming("t", 120) }, "t:120|ms"},
+				{func() { client.SendSampledTiming("t", 120, .1) }, "t:120|ms|@0.1"},
+				{func() { client.SetGauge("g", 7) }, "g:7|g"},
+				{func() { client.SetGauge("g", -7) }, "g:0|g\ng:-7|g"},
+				{func() { client.AdjustGauge("g", 3) }, "g:+3|g"},
+				{func() { client.AdjustGauge("g", -3) }, "g:-3|g"},
+				{func() { client.AddToSet("s", "user:1|x") }, "s:user_1_x|s"},
+				{func() { client.SendHistogram("h", 250) }, "h:250|h"},
+				{func() { client.SendTiming("t", 12.5) }, "t:12.5|ms"},
+				{func() { client.SetGauge("g", -0.25) }, "g:0|g\ng:-0.25|g"},
+				{func() { client.AdjustGauge("g", 0.5) }, "g:+0.5|g"},
+				{func() { client.IncrementCounter("a", 5000000000) }, "a:5000000000|c"},
+				{func() { client.SendSampledHistogram("h", 250, .25) }, "h:250|h|@0.25"},
+				{func() { client.IncrementSampledCounter("a", 1, .5, "env:prod", "az:b") },
+					"a:1|c|@0.5|#env:prod,az:b"},
+				{func() { client.SetGauge("g", -1, "env:prod") },
+					"g:0|g|#env:prod\ng:-1|g|#env:prod"},
+			}
+			for _, test := range tests {
+				test.send()
+				c.Expect(receive(), gs.Equals, test.exp)
+			}
+		})
+
+		c.Specify("packs buffered metrics into packets", func() {
+			conf.FlushInterval = time.Hour
+			conf.MaxPacketSize = 40
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			for i := 0; i < 4; i++ {
+				client.IncrementCounter("requests", 1)
+				client.SendSampledTiming("latency", float64(100+i), .1)
+			}
+			client.AddToSet("users", strings.Repeat("x", 50))
+			client.Close()
+
+			c.Expect(receive(), gs.Equals, "requests:1|c\nlatency:100|ms|@0.1")
+			c.Expect(receive(), gs.Equals, "requests:1|c\nlatency:101|ms|@0.1")
+			c.Expect(receive(), gs.Equals, "requests:1|c\nlatency:102|ms|@0.1")
+			c.Expect(receive(), gs.Equals, "requests:1|c\nlatency:103|ms|@0.1")
+			// too long for any packet, so it's sent on its own
+			c.Expect(receive(), gs.Equals, "users:"+strings.Repeat("x", 50)+"|s")
+		})
+
+		c.Specify("aggregates counters and gauges", func() {
+			conf.FlushInterval = time.Hour
+			conf.Aggregate = true
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			client.IncrementCounter("requests", 1)
+			client.IncrementCounter("requests", 2)
+			client.IncrementSampledCounter("requests", 1, .5)
+			client.IncrementCounter("requests", 1, "env:prod")
+			client.IncrementSampledCounter("errors", 1, .3)
+			client.SetGauge("queue", 5)
+			client.AdjustGauge("queue", -2)
+			client.AdjustGauge("workers", 3)
+			client.AdjustGauge("workers", -1)
+			client.SetGauge("temperature", -4)
+			client.SendSampledTiming("latency", 100, .1)
+			client.SendSampledTiming("latency", 100, .1)
+			client.Flush()
+
+			c.Expect(receive(), gs.Equals, strings.Join([]string{
+				// timers are forwarded as they are
+				"latency:100|ms|@0.1",
+				"latency:100|ms|@0.1",
+				"errors:3.3333333333333335|c",
+				"requests:5|c",
+				"requests:1|c|#env:prod",
+				"queue:3|g",
+				"temperature:0|g",
+				"temperature:-4|g",
+				"workers:+2|g",
+			}, "\n"))
+
+			// the aggregates start over after each flush
+			client.IncrementCounter("requests", 1)
+			client.Close()
+			c.Expect(receive(), gs.Equals, "requests:1|c")
+		})
+
+		c.Specify("flushes on its interval", func() {
+			conf.FlushInterval = 10 * time.Millisecond
+			conf.Aggregate = true
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			defer client.Close()
+			client.IncrementCounter("requests", 1)
+			c.Expect(receive(), gs.Equals, "requests:1|c")
+		})
+
+		c.Specify("writes newline terminated lines over tcp", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			conf.Network = "tcp"
+			conf.Addr = ln.Addr().String()
+			conf.FlushInterval = time.Hour
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			defer client.Close()
+			conn, err := ln.Accept()
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+
+			client.IncrementCounter("a", 1)
+			client.SendTiming("t", 5)
+			client.Flush()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			r := bufio.NewReader(conn)
+			for _, exp := range []string{"a:1|c\n", "t:5|ms\n"} {
+				line, err := r.ReadString('\n')
+				c.Expect(err, gs.IsNil)
+				c.Expect(line, gs.Equals, exp)
+			}
+		})
+
+		c.Specify("drops metrics a stalled tcp server doesn't read", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			conf.Network = "tcp"
+			conf.Addr = ln.Addr().String()
+			conf.WriteTimeout = 50 * time.Millisecond
+			conf.BackoffMin = time.Hour
+			conf.BackoffMax = time.Hour
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			defer client.Close()
+			// The server accepts connections but never reads from them, so
+			// the socket buffers fill up and writes block.
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					defer conn.Close()
+				}
+			}()
+
+			done := make(chan bool)
+			go func() {
+				member := strings.Repeat("x", 64*1024)
+				for i := 0; i < 2000 && client.Healthy(); i++ {
+					client.AddToSet("users", member)
+				}
+				done <- !client.Healthy()
+			}()
+			select {
+			case gaveUp := <-done:
+				c.Expect(gaveUp, gs.IsTrue)
+			case <-time.After(10 * time.Second):
+				c.Expect("client", gs.Equals, "not stalled")
+			}
+		})
+
+		c.Specify("reconnects to tcp servers that drop the connection", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			conf.Network = "tcp"
+			conf.Addr = ln.Addr().String()
+			conf.BackoffMin = 10 * time.Millisecond
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			defer client.Close()
+			conn, err := ln.Accept()
+			c.Assume(err, gs.IsNil)
+			conn.Close()
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+			// Writes to the dropped connection may succeed until the reset
+			// arrives, so keep sending until the client reconnects.
+			timeout := time.Now().Add(2 * time.Second)
+			for conn = nil; conn == nil && time.Now().Before(timeout); {
+				client.IncrementCounter("b", 1)
+				select {
+				case conn = <-accepted:
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			c.Assume(conn, gs.Not(gs.IsNil))
+			defer conn.Close()
+			client.IncrementCounter("c", 1)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			r := bufio.NewReader(conn)
+			var line string
+			for line != "c:1|c\n" && err == nil {
+				line, err = r.ReadString('\n')
+			}
+			c.Expect(line, gs.Equals, "c:1|c\n")
+		})
+
+		c.Specify("writes to unix datagram sockets, once they appear", func() {
+			path := tempSocketPath()
+			conf.Network = "unixgram"
+			conf.Addr = path
+			conf.BackoffMin = 10 * time.Millisecond
+			client, err := NewStatsdNetClient(conf)
+			c.Assume(err, gs.IsNil)
+			defer client.Close()
+
+			sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path,
+				Net: "unixgram"})
+			c.Assume(err, gs.IsNil)
+			defer os.Remove(path)
+			defer sock.Close()
+
+			received := make(chan string, 1)
+			go func() {
+				buf := make([]byte, 1024)
+				sock.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, err := sock.Read(buf)
+				if err != nil {
+					received <- err.Error()
+					return
+				}
+				received <- string(buf[:n])
+			}()
+			var got string
+			for got == "" {
+				client.SetGauge("g", 1.5)
+				select {
+				case got = <-received:
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			c.Expect(got, gs.Equals, "g:1.5|g")
+		})
+
+		c.Specify("rejects unknown networks", func() {
+			conf.Network = "sctp"
+			_, err := NewStatsdNetClient(conf)
+			c.Expect(err.Error(), gs.Equals, "unknown statsd network: sctp")
+		})
+
+		c.Specify("requires a flush interval to aggregate", func() {
+			conf.Aggregate = true
+			_, err := NewStatsdNetClient(conf)
+			c.Expect(err.Error(), gs.Equals, "statsd aggregation requires a flush interval")
+		})
+
+		c.Specify("is flushed when the output stops", func() {
+			output := new(StatsdOutput)
+			config := output.ConfigStruct().(*StatsdOutputConfig)
+			config.Url = conf.Addr
+			config.FlushInterval = "1h"
+			config.Aggregate = true
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			inChan := make(chan *pipeline.PipelinePack, 2)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().UpdateCursor("").AnyTimes()
+			inChan <- getStatsdPack("counter", "3")
+			inChan <- getStatsdPack("timer", "20")
+			close(inChan)
+			output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(receive(), gs.Equals,
+				"thenamespace.myname:20|ms|@0.3\nthenamespace.myname:10|c")
+		})
+	})
+
+	c.Specify("parseStatsdUrl", func() {
+		tests := []struct {
+			url     string
+			network string
+			addr    string
+			err     string
+		}{
+			{"localhost:8125", "udp", "localhost:8125", ""},
+			{"udp://localhost:8125", "udp", "localhost:8125", ""},
+			{"tcp://127.0.0.1:8125", "tcp", "127.0.0.1:8125", ""},
+			{"unixgram:///var/run/statsd.sock", "unixgram", "/var/run/statsd.sock", ""},
+			{"http://localhost:8125", "", "", "StatsdOutput unknown url scheme: http"},
+			{"tcp://", "", "", "StatsdOutput url has no address: tcp://"},
+		}
+		for _, test := range tests {
+			network, addr, err := parseStatsdUrl(test.url)
+			c.Expect(network, gs.Equals, test.network)
+			c.Expect(addr, gs.Equals, test.addr)
+			if test.err == "" {
+				c.Expect(err, gs.IsNil)
+			} else {
+				c.Expect(err.Error(), gs.Equals, test.err)
+			}
+		}
+	})
+
+	c.Specify("A StatsdOutput rejects bad batching settings", func() {
+		output := new(StatsdOutput)
+		config := output.ConfigStruct().(*StatsdOutputConfig)
+		config.FlushInterval = "often"
+		err := output.Init(config)
+		c.Expect(strings.HasPrefix(err.Error(),
+			"StatsdOutput invalid flush_interval 'often': "), gs.IsTrue)
+
+		config.FlushInterval = ""
+		config.Aggregate = true
+		err = output.Init(config)
+		c.Expect(err.Error(), gs.Equals, "StatsdOutput aggregate requires a flush_interval")
+	})
+}
+
+func StatsdLineDecoderSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	decoder := new(StatsdLineDecoder)
+	config := decoder.ConfigStruct().(*StatsdLineDecoderConfig)
+	decoder.Init(config)
+	dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
+	decoder.SetDecoderRunner(dRunner)
+	pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+	pack.Message.SetLogger("UdpInput")
+	pack.Message.SetHostname("web1")
+	pack.Message.SetUuid([]byte("0123456789abcdef"))
+
+	// expectNewPacks has the decoder runner hand out n fresh packs, for
+	// the extra lines of a payload.
+	expectNewPacks := func(n int) {
+		for i := 0; i < n; i++ {
+			newPack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			dRunner.EXPECT().NewPack().Return(newPack)
+		}
+	}
+
+	fieldValue := func(name string) interface{} {
+		value, _ := pack.Message.GetFieldValue(name)
+		return value
+	}
+
+	c.Specify("A StatsdLineDecoder", func() {
+		c.Specify("decodes every metric type", func() {
+			tests := []struct {
+				line    string
+				msgType string
+				payload string
+			}{
+				{"app.requests:1|c", "counter", "1"},
+				{"app.latency:12.5|ms", "timer", "12.5"},
+				{"app.queue:-3|g", "gauge", "-3"},
+				{"app.users:user-1234|s", "set", "user-1234"},
+				{"app.size:250|h\n", "histogram", "250"},
+			}
+			for _, test := range tests {
+				pack = pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+				pack.Message.SetPayload(test.line)
+				packs, err := decoder.Decode(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(packs), gs.Equals, 1)
+				c.Expect(pack.Message.GetType(), gs.Equals, test.msgType)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, test.payload)
+				c.Expect(fieldValue("rate"), gs.Equals, 1.0)
+			}
+		})
+
+		c.Specify("decodes sample rates and tags", func() {
+			config.TagPrefix = "tag."
+			decoder.Init(config)
+			pack.Message.SetPayload("app.requests:3|c|@0.25|#env:prod,canary,az:us:b")
+			_, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "")
+			c.Expect(fieldValue("name"), gs.Equals, "app.requests")
+			c.Expect(fieldValue("rate"), gs.Equals, 0.25)
+			c.Expect(fieldValue("tag.env"), gs.Equals, "prod")
+			c.Expect(fieldValue("tag.canary"), gs.Equals, "")
+			c.Expect(fieldValue("tag.az"), gs.Equals, "us:b")
+		})
+
+		c.Specify("produces messages StatsdOutput sends on", func() {
+			output := new(StatsdOutput)
+			outputConfig := output.ConfigStruct().(*StatsdOutputConfig)
+			outputConfig.TagFields = []string{"env"}
+			err := output.Init(outputConfig)
+			c.Assume(err, gs.IsNil)
+			tests := []struct {
+				line string
+				exp  StatsdMsg
+			}{
+				{"app.queue:+2|g|#env:prod", StatsdMsg{msgType: "gauge",
+					key: "app.queue", value: 2, rate: 1, delta: true, tags: "env:prod"}},
+				{"app.requests:3|c|@0.5", StatsdMsg{msgType: "counter",
+					key: "app.requests", count: 3, rate: 0.5}},
+				{"app.latency:12.5|ms", StatsdMsg{msgType: "timer",
+					key: "app.latency", value: 12.5, rate: 1}},
+				{"app.users:alice|s", StatsdMsg{msgType: "set", key: "app.users",
+					rate: 1, member: "alice"}},
+				{"app.size:250|h", StatsdMsg{msgType: "histogram", key: "app.size",
+					value: 250, rate: 1}},
+			}
+			for _, test := range tests {
+				pack = pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+				pack.Message.SetPayload(test.line)
+				_, err = decoder.Decode(pack)
+				c.Assume(err, gs.IsNil)
+				msg := new(StatsdMsg)
+				err = output.prepStatsdMsg(pack, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(*msg, gs.Equals, test.exp)
+			}
+
+			// Counters StatsdOutput can't send are rejected by the decoder.
+			pack.Message.SetPayload("app.requests:1.5|c")
+			_, err = decoder.Decode(pack)
+			c.Expect(err.Error(), gs.Equals,
+				"statsd line counter is not a whole number: 1.5")
+		})
+
+		c.Specify("decodes each line into its own pack", func() {
+			expectNewPacks(2)
+			pack.Message.SetPayload("app.requests:1|c\n\napp.latency:12|ms\r\n" +
+				"app.queue:3|g|#env:prod\n")
+			packs, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(packs), gs.Equals, 3)
+			c.Expect(packs[0], gs.Equals, pack)
+			for i, exp := range []struct {
+				msgType string
+				name    string
+				payload string
+			}{
+				{"counter", "app.requests", "1"},
+				{"timer", "app.latency", "12"},
+				{"gauge", "app.queue", "3"},
+			} {
+				msg := packs[i].Message
+				c.Expect(msg.GetType(), gs.Equals, exp.msgType)
+				c.Expect(msg.GetPayload(), gs.Equals, exp.payload)
+				c.Expect(msg.GetHostname(), gs.Equals, "web1")
+				name, _ := msg.GetFieldValue("name")
+				c.Expect(name, gs.Equals, exp.name)
+				c.Expect(len(msg.FindAllFields("name")), gs.Equals, 1)
+			}
+			c.Expect(string(packs[1].Message.GetUuid()) != "0123456789abcdef", gs.IsTrue)
+			env, _ := packs[2].Message.GetFieldValue("env")
+			c.Expect(env, gs.Equals, "prod")
+		})
+
+		c.Specify("decodes a packet StatsdNetClient sent", func() {
+			sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer sock.Close()
+			client, err := NewStatsdNetClient(&StatsdClientConfig{
+				Addr: sock.LocalAddr().String(), FlushInterval: time.Hour})
+			c.Assume(err, gs.IsNil)
+			client.IncrementSampledCounter("requests", 2, .5)
+			client.SendTiming("latency", 12.5, "env:prod")
+			client.SetGauge("queue", -4)
+			client.AddToSet("users", "alice")
+			client.Close()
+			buf := make([]byte, 1024)
+			sock.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := sock.ReadFrom(buf)
+			c.Assume(err, gs.IsNil)
+
+			// The negative gauge is sent as two lines, a reset and a delta.
+			expectNewPacks(4)
+			pack.Message.SetPayload(string(buf[:n]))
+			packs, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(packs), gs.Equals, 5)
+			for i, exp := range []string{"counter requests 2", "timer latency 12.5",
+				"gauge queue 0", "gauge queue -4", "set users alice"} {
+
+				msg := packs[i].Message
+				name, _ := msg.GetFieldValue("name")
+				c.Expect(fmt.Sprintf("%s %s %s", msg.GetType(), name,
+					msg.GetPayload()), gs.Equals, exp)
+			}
+			rate, _ := packs[0].Message.GetFieldValue("rate")
+			c.Expect(rate, gs.Equals, 0.5)
+			env, _ := packs[1].Message.GetFieldValue("env")
+			c.Expect(env, gs.Equals, "prod")
+		})
+
+		c.Specify("logs and skips malformed lines among good ones", func() {
+			expectNewPacks(1)
+			dRunner.EXPECT().LogError(errors.New("unknown statsd metric type: x"))
+			pack.Message.SetPayload("a:1|c\nb:2|x\nc:3|c")
+			packs, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 2)
+			name, _ := packs[1].Message.GetFieldValue("name")
+			c.Expect(name, gs.Equals, "c")
+		})
+
+		c.Specify("produces messages HekaStatsFilter accumulates", func() {
+			expectNewPacks(5)
+			pack.Message.SetPayload("requests:2|c|@0.5\nlatency:12.5|ms\nqueue:7|g\n" +
+				"queue:+1|g\nusers:alice|s\nsize:3|h")
+			packs, err := decoder.Decode(pack)
+			c.Assume(err, gs.IsNil)
+			inChan := make(chan *pipeline.PipelinePack, len(packs))
+			for _, p := range packs {
+				inChan <- p
+			}
+			close(inChan)
+
+			filter := new(HekaStatsFilter)
+			filter.Init(filter.ConfigStruct())
+			fRunner := pipelinemock.NewMockFilterRunner(ctrl)
+			fRunner.EXPECT().InChan().Return(inChan)
+			fRunner.EXPECT().UpdateCursor(gomock.Any()).Times(len(packs))
+			helper := pipelinemock.NewMockPluginHelper(ctrl)
+			statAccum := pipelinemock.NewMockStatAccumulator(ctrl)
+			helper.EXPECT().StatAccumulator("StatAccumInput").Return(statAccum, nil)
+			// Gauge adjustments, sets and histograms are rejected.
+			for _, stat := range []pipeline.Stat{
+				{Bucket: "requests", Value: "2", Modifier: "", Sampling: 0.5},
+				{Bucket: "latency", Value: "12.5", Modifier: "ms", Sampling: 1},
+				{Bucket: "queue", Value: "7", Modifier: "g", Sampling: 1},
+			} {
+				statAccum.EXPECT().DropStat(stat).Return(true)
+			}
+			err = filter.Run(fRunner, helper)
+			c.Expect(err, gs.IsNil)
+		})
+
+		c.Specify("rejects malformed lines", func() {
+			tests := map[string]string{
+				"app.requests":            "statsd line has no bucket name: app.requests",
+				":1|c":                    "statsd line has no bucket name: :1|c",
+				"app.requests:1":          "statsd line has no metric type: app.requests:1",
+				"app.requests:1|x":        "unknown statsd metric type: x",
+				"app.requests:one|c":      "statsd line counter is not a whole number: one",
+				"app.latency:one|ms":      "statsd line value is not a number: one",
+				"app.latency:NaN|ms":      "statsd line value is not a number: NaN",
+				"app.users:|s":            "statsd line has no set member",
+				"app.requests:1|c|@2":     "invalid statsd sample rate: 2",
+				"app.requests:1|c|T12345": "unknown statsd line section: T12345",
+				"\r\n\n":                  "statsd payload holds no lines",
+				"a:1|x\nb:2|y":            "unknown statsd metric type: x",
+			}
+			for line, exp := range tests {
+				pack.Message.SetPayload(line)
+				_, err := decoder.Decode(pack)
+				c.Expect(err.Error(), gs.Equals, exp)
+			}
 		})
 	})
 }
@@ -0,0 +1,508 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statsd metric type suffixes.
+const (
+	STATSD_COUNTER   = "c"
+	STATSD_TIMER     = "ms"
+	STATSD_GAUGE     = "g"
+	STATSD_SET       = "s"
+	STATSD_HISTOGRAM = "h"
+)
+
+// Default size limit of packets holding several metrics, which keeps them
+// from being fragmented on Ethernet networks.
+const STATSD_MAX_PACKET_SIZE = 1432
+
+// Default bounds of the delay before reconnecting to a statsd server that
+// couldn't be reached, which doubles with each consecutive failure.
+const (
+	STATSD_BACKOFF_MIN = 100 * time.Millisecond
+	STATSD_BACKOFF_MAX = 30 * time.Second
+)
+
+// Default of how long a write may block before the metric is dropped.
+const STATSD_WRITE_TIMEOUT = 5 * time.Second
+
+// How long a connection attempt may take.
+var statsdDialTimeout = 5 * time.Second
+
+// StatsdClientConfig holds the settings used to create a StatsdNetClient.
+type StatsdClientConfig struct {
+	// "udp", "tcp" or "unixgram". Defaults to "udp".
+	Network string
+	// host:port of the statsd server, or the socket path for unixgram.
+	Addr string
+	// How long metrics are buffered before they're sent. Zero sends each
+	// metric right away, in a packet of its own.
+	FlushInterval time.Duration
+	// Largest packet sent when buffering, as many metrics as fit are
+	// packed into each. Defaults to STATSD_MAX_PACKET_SIZE.
+	MaxPacketSize int
+	// Sum counters and combine gauge updates over each flush interval, so
+	// a single line per bucket and tags is sent. Requires a FlushInterval.
+	Aggregate bool
+	// Bounds of the reconnect backoff. Default to STATSD_BACKOFF_MIN and
+	// STATSD_BACKOFF_MAX.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// How long a write may block, as it does once a TCP server stops
+	// reading, before the metric is dropped and the connection replaced.
+	// Defaults to STATSD_WRITE_TIMEOUT.
+	WriteTimeout time.Duration
+}
+
+// StatsdNetClient is a StatsdClient writing the statsd line protocol over
+// UDP, TCP or a unix datagram socket, with DogStatsD tags. Over TCP every
+// write ends with a newline. Write errors and writes blocking past the
+// write timeout are dropped, since losing a metric is better than stalling
+// the output; the connection is replaced, backing off while the server
+// can't be reached. Sampled metrics are
+// forwarded with their rate, they aren't sampled again.
+type StatsdNetClient struct {
+	network       string
+	addr          string
+	flushInterval time.Duration
+	maxPacketSize int
+	aggregate     bool
+	backoffMin    time.Duration
+	backoffMax    time.Duration
+	writeTimeout  time.Duration
+
+	lock      sync.Mutex // guards the connection, packet and the aggregates
+	conn      net.Conn
+	failures  int       // consecutive connection failures
+	retryAt   time.Time // no reconnects are attempted before this
+	connected time.Time
+	packet    bytes.Buffer
+	counters  map[string]*statsdCounter
+	gauges    map[string]*statsdGauge
+
+	stopOnce    sync.Once
+	stopChan    chan struct{}
+	flusherDone chan struct{}
+}
+
+// A counter summed over a flush interval.
+type statsdCounter struct {
+	bucket string
+	tags   []string
+	value  float64
+}
+
+// A gauge's updates over a flush interval. Unless one of them set the
+// gauge, value is the sum of the adjustments.
+type statsdGauge struct {
+	bucket   string
+	tags     []string
+	value    float64
+	absolute bool
+}
+
+// NewStatsdNetClient returns a client sending to the statsd server at
+// conf.Addr. Dialing UDP only fails for bad addresses, which are returned.
+// A TCP or unixgram server that can't be reached yet is retried once the
+// backoff has passed.
+func NewStatsdNetClient(conf *StatsdClientConfig) (*StatsdNetClient, error) {
+	if conf.Aggregate && conf.FlushInterval <= 0 {
+		return nil, errors.New("statsd aggregation requires a flush interval")
+	}
+	sc := &StatsdNetClient{
+		network:       conf.Network,
+		addr:          conf.Addr,
+		flushInterval: conf.FlushInterval,
+		maxPacketSize: conf.MaxPacketSize,
+		aggregate:     conf.Aggregate,
+		backoffMin:    conf.BackoffMin,
+		backoffMax:    conf.BackoffMax,
+		writeTimeout:  conf.WriteTimeout,
+		counters:      make(map[string]*statsdCounter),
+		gauges:        make(map[string]*statsdGauge),
+	}
+	switch sc.network {
+	case "":
+		sc.network = "udp"
+	case "udp", "tcp", "unixgram":
+	default:
+		return nil, fmt.Errorf("unknown statsd network: %s", sc.network)
+	}
+	if sc.maxPacketSize <= 0 {
+		sc.maxPacketSize = STATSD_MAX_PACKET_SIZE
+	}
+	if sc.backoffMin <= 0 {
+		sc.backoffMin = STATSD_BACKOFF_MIN
+	}
+	if sc.backoffMax <= 0 {
+		sc.backoffMax = STATSD_BACKOFF_MAX
+	}
+	if sc.writeTimeout <= 0 {
+		sc.writeTimeout = STATSD_WRITE_TIMEOUT
+	}
+	if sc.backoffMax < sc.backoffMin {
+		return nil, errors.New("statsd backoff maximum is less than the minimum")
+	}
+	if err := sc.connect(); err != nil && sc.network == "udp" {
+		return nil, err
+	}
+	if sc.flushInterval > 0 {
+		sc.stopChan = make(chan struct{})
+		sc.flusherDone = make(chan struct{})
+		go sc.flusher()
+	}
+	return sc, nil
+}
+
+func (sc *StatsdNetClient) IncrementCounter(bucket string, n int64, tags ...string) {
+	sc.count(bucket, n, 1, tags)
+}
+
+func (sc *StatsdNetClient) IncrementSampledCounter(bucket string, n int64, srate float32,
+	tags ...string) {
+
+	sc.count(bucket, n, srate, tags)
+}
+
+func (sc *StatsdNetClient) SendTiming(bucket string, ms float64, tags ...string) {
+	sc.write(statsdLine(bucket, statsdFloat(ms), STATSD_TIMER, 1, tags))
+}
+
+func (sc *StatsdNetClient) SendSampledTiming(bucket string, ms float64, srate float32,
+	tags ...string) {
+
+	sc.write(statsdLine(bucket, statsdFloat(ms), STATSD_TIMER, srate, tags))
+}
+
+// SetGauge sets a gauge to an absolute value. Statsd reads a leading sign
+// as an adjustment, so a negative value is sent as a reset to zero
+// followed by a decrement, in a single packet.
+func (sc *StatsdNetClient) SetGauge(bucket string, value float64, tags ...string) {
+	if sc.aggregate {
+		sc.lock.Lock()
+		g := sc.gauge(bucket, tags)
+		g.value, g.absolute = value, true
+		sc.lock.Unlock()
+		return
+	}
+	sc.write(statsdGaugeLines(bucket, value, true, tags))
+}
+
+// AdjustGauge adds delta to a gauge's current value.
+func (sc *StatsdNetClient) AdjustGauge(bucket string, delta float64, tags ...string) {
+	if sc.aggregate {
+		sc.lock.Lock()
+		sc.gauge(bucket, tags).value += delta
+		sc.lock.Unlock()
+		return
+	}
+	sc.write(statsdGaugeLines(bucket, delta, false, tags))
+}
+
+// AddToSet records an occurrence of member, so the server can count the
+// unique members seen each flush interval.
+func (sc *StatsdNetClient) AddToSet(bucket string, member string, tags ...string) {
+	member = statsdSetMemberReplacer.Replace(member)
+	sc.write(statsdLine(bucket, member, STATSD_SET, 1, tags))
+}
+
+func (sc *StatsdNetClient) SendHistogram(bucket string, value float64, tags ...string) {
+	sc.write(statsdLine(bucket, statsdFloat(value), STATSD_HISTOGRAM, 1, tags))
+}
+
+func (sc *StatsdNetClient) SendSampledHistogram(bucket string, value float64, srate float32,
+	tags ...string) {
+
+	sc.write(statsdLine(bucket, statsdFloat(value), STATSD_HISTOGRAM, srate, tags))
+}
+
+// Flush sends everything buffered or aggregated so far.
+func (sc *StatsdNetClient) Flush() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	keys := make([]string, 0, len(sc.counters))
+	for key := range sc.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := sc.counters[key]
+		sc.addLine(statsdLine(c.bucket, statsdFloat(c.value), STATSD_COUNTER, 1, c.tags))
+	}
+
+	keys = keys[:0]
+	for key := range sc.gauges {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		g := sc.gauges[key]
+		sc.addLine(statsdGaugeLines(g.bucket, g.value, g.absolute, g.tags))
+	}
+
+	sc.counters = make(map[string]*statsdCounter)
+	sc.gauges = make(map[string]*statsdGauge)
+	sc.sendPacket()
+}
+
+// Healthy reports whether the client is connected or may try to
+// reconnect, rather than backing off after a failure.
+func (sc *StatsdNetClient) Healthy() bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.conn != nil || !time.Now().Before(sc.retryAt)
+}
+
+// Close flushes the client and closes its socket.
+func (sc *StatsdNetClient) Close() (err error) {
+	if sc.stopChan != nil {
+		sc.stopOnce.Do(func() {
+			close(sc.stopChan)
+		})
+		<-sc.flusherDone
+	}
+	sc.Flush()
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.conn != nil {
+		err = sc.conn.Close()
+		sc.conn = nil
+	}
+	return
+}
+
+func (sc *StatsdNetClient) flusher() {
+	defer close(sc.flusherDone)
+	ticker := time.NewTicker(sc.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sc.Flush()
+		case <-sc.stopChan:
+			return
+		}
+	}
+}
+
+func (sc *StatsdNetClient) count(bucket string, n int64, srate float32, tags []string) {
+	if !sc.aggregate {
+		sc.write(statsdLine(bucket, strconv.FormatInt(n, 10), STATSD_COUNTER, srate, tags))
+		return
+	}
+	// Sampled counts are scaled up, the way the server would. The rate is
+	// converted through its decimal form, so 0.3 scales by 1/0.3 rather
+	// than by the inverse of the nearest float32.
+	value := float64(n)
+	if srate > 0 && srate < 1 {
+		rate, _ := strconv.ParseFloat(strconv.FormatFloat(float64(srate), 'f', -1, 32), 64)
+		value /= rate
+	}
+	key := statsdAggregateKey(bucket, tags)
+	sc.lock.Lock()
+	c, ok := sc.counters[key]
+	if !ok {
+		c = &statsdCounter{bucket: bucket, tags: tags}
+		sc.counters[key] = c
+	}
+	c.value += value
+	sc.lock.Unlock()
+}
+
+// gauge returns the aggregate for a gauge, creating it if needed. The
+// caller must hold the lock.
+func (sc *StatsdNetClient) gauge(bucket string, tags []string) *statsdGauge {
+	key := statsdAggregateKey(bucket, tags)
+	g, ok := sc.gauges[key]
+	if !ok {
+		g = &statsdGauge{bucket: bucket, tags: tags}
+		sc.gauges[key] = g
+	}
+	return g
+}
+
+// write sends lines right away, or buffers them when the client has a
+// flush interval.
+func (sc *StatsdNetClient) write(lines string) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if sc.flushInterval <= 0 {
+		sc.send([]byte(lines))
+		return
+	}
+	sc.addLine(lines)
+}
+
+// addLine appends lines to the pending packet, sending the packet first if
+// they wouldn't fit. Lines too long for any packet are sent on their own.
+// The caller must hold the lock.
+func (sc *StatsdNetClient) addLine(lines string) {
+	if sc.packet.Len() > 0 && sc.packet.Len()+1+len(lines) > sc.maxPacketSize {
+		sc.sendPacket()
+	}
+	if sc.packet.Len() > 0 {
+		sc.packet.WriteByte('\n')
+	}
+	sc.packet.WriteString(lines)
+}
+
+// sendPacket writes the pending packet, if any. The caller must hold the
+// lock.
+func (sc *StatsdNetClient) sendPacket() {
+	if sc.packet.Len() == 0 {
+		return
+	}
+	sc.send(sc.packet.Bytes())
+	sc.packet.Reset()
+}
+
+// send writes a packet, connecting first if needed. A broken connection is
+// replaced right away the first time, after that the client backs off
+// until a connection has stayed up for at least the minimum backoff. The
+// caller must hold the lock.
+func (sc *StatsdNetClient) send(packet []byte) {
+	if sc.network == "tcp" {
+		// The full slice expression makes append copy the packet.
+		packet = append(packet[:len(packet):len(packet)], '\n')
+	}
+	if sc.conn != nil {
+		if err := sc.writeConn(packet); err == nil {
+			sc.wrote()
+			return
+		}
+		sc.markFailed()
+		if sc.failures == 1 {
+			sc.retryAt = time.Time{}
+		}
+	}
+	if err := sc.connect(); err != nil {
+		return
+	}
+	if err := sc.writeConn(packet); err != nil {
+		sc.markFailed()
+		return
+	}
+	sc.wrote()
+}
+
+// writeConn writes a packet to the connection, giving up once the write
+// timeout has passed. The caller must hold the lock.
+func (sc *StatsdNetClient) writeConn(packet []byte) (err error) {
+	if err = sc.conn.SetWriteDeadline(time.Now().Add(sc.writeTimeout)); err != nil {
+		return
+	}
+	_, err = sc.conn.Write(packet)
+	return
+}
+
+// connect dials the server, unless the client is backing off after failed
+// attempts. The caller must hold the lock, except from the constructor.
+func (sc *StatsdNetClient) connect() error {
+	now := time.Now()
+	if now.Before(sc.retryAt) {
+		return fmt.Errorf("statsd server '%s' is down, retrying in %s", sc.addr,
+			sc.retryAt.Sub(now))
+	}
+	conn, err := net.DialTimeout(sc.network, sc.addr, statsdDialTimeout)
+	if err != nil {
+		sc.markFailed()
+		return err
+	}
+	sc.conn = conn
+	sc.connected = now
+	return nil
+}
+
+// markFailed records a failure, closes the connection and puts the client
+// into backoff. The caller must hold the lock.
+func (sc *StatsdNetClient) markFailed() {
+	sc.failures++
+	backoff := sc.backoffMin
+	for i := 1; i < sc.failures && backoff < sc.backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > sc.backoffMax {
+		backoff = sc.backoffMax
+	}
+	sc.retryAt = time.Now().Add(backoff)
+	if sc.conn != nil {
+		// ignore err from close, the connection is replaced anyway
+		sc.conn.Close()
+		sc.conn = nil
+	}
+}
+
+// wrote records a successful write. The caller must hold the lock.
+func (sc *StatsdNetClient) wrote() {
+	if time.Since(sc.connected) >= sc.backoffMin {
+		sc.failures = 0
+	}
+}
+
+// statsdLine renders a single metric, adding the sample rate if it's
+// below 1 and any DogStatsD tags.
+func statsdLine(bucket, value, metricType string, srate float32, tags []string) string {
+	line := bucket + ":" + value + "|" + metricType
+	if srate < 1 {
+		line += "|@" + strconv.FormatFloat(float64(srate), 'f', -1, 32)
+	}
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// statsdGaugeLines renders a gauge update, either setting the gauge to
+// value or adjusting it by value.
+func statsdGaugeLines(bucket string, value float64, absolute bool, tags []string) string {
+	if !absolute {
+		delta := statsdFloat(value)
+		if value >= 0 {
+			// Adjustments always carry a sign.
+			delta = "+" + delta
+		}
+		return statsdLine(bucket, delta, STATSD_GAUGE, 1, tags)
+	}
+	line := statsdLine(bucket, statsdFloat(value), STATSD_GAUGE, 1, tags)
+	if value < 0 {
+		line = statsdLine(bucket, "0", STATSD_GAUGE, 1, tags) + "\n" + line
+	}
+	return line
+}
+
+// statsdFloat renders a value in its shortest form, without an exponent.
+func statsdFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func statsdAggregateKey(bucket string, tags []string) string {
+	return bucket + "|#" + strings.Join(tags, ",")
+}
+
+// Replaces the characters that would end a set member early.
+var statsdSetMemberReplacer = strings.NewReplacer(":", "_", "|", "_", "\n", "_",
+	"\r", "_")
@@ -0,0 +1,229 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Points each node gets on the hash ring. More points spread the buckets
+// more evenly.
+const STATSD_RING_REPLICAS = 160
+
+// StatsdRing maps bucket names onto nodes with consistent hashing, so each
+// bucket is pinned to one node and adding or removing a node only moves
+// the buckets that node owns. It doesn't touch the network.
+type StatsdRing struct {
+	points []uint32 // sorted
+	owners []string // owners[i] is the node at points[i]
+}
+
+// NewStatsdRing returns a ring holding the given nodes, which must be
+// unique. The mapping only depends on the node names, not their order.
+func NewStatsdRing(nodes []string) (*StatsdRing, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("statsd ring needs at least one node")
+	}
+	seen := make(map[string]bool, len(nodes))
+	ring := &StatsdRing{}
+	for _, node := range nodes {
+		if seen[node] {
+			return nil, fmt.Errorf("statsd ring node listed twice: %s", node)
+		}
+		seen[node] = true
+		for i := 0; i < STATSD_RING_REPLICAS; i++ {
+			ring.points = append(ring.points, statsdHash(node+"#"+strconv.Itoa(i)))
+			ring.owners = append(ring.owners, node)
+		}
+	}
+	sort.Sort(ring)
+	return ring, nil
+}
+
+func (r *StatsdRing) Len() int {
+	return len(r.points)
+}
+
+// Less orders by point, and by node for the rare colliding points so the
+// order stays deterministic.
+func (r *StatsdRing) Less(i, j int) bool {
+	if r.points[i] != r.points[j] {
+		return r.points[i] < r.points[j]
+	}
+	return r.owners[i] < r.owners[j]
+}
+
+func (r *StatsdRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+// Node returns the node owning bucket, skipping the nodes up reports as
+// down, so their buckets move to the next node on the ring until they come
+// back. A nil up treats every node as up. It returns false if every node
+// is down.
+func (r *StatsdRing) Node(bucket string, up func(node string) bool) (string, bool) {
+	h := statsdHash(bucket)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	checked := make(map[string]bool)
+	for i := 0; i < len(r.points); i++ {
+		node := r.owners[(start+i)%len(r.points)]
+		if checked[node] {
+			continue
+		}
+		if up == nil || up(node) {
+			return node, true
+		}
+		checked[node] = true
+	}
+	return "", false
+}
+
+func statsdHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// StatsdClusterClient is a StatsdClient spreading buckets over several
+// statsd servers with a StatsdRing. A server whose client is backing off
+// after a failure is skipped until its backoff has passed, when it's tried
+// again. Metrics are dropped while every server is down.
+type StatsdClusterClient struct {
+	ring    *StatsdRing
+	clients map[string]*StatsdNetClient
+}
+
+// NewStatsdClusterClient returns a client for the servers in confs, keyed
+// by the names they're known by on the ring.
+func NewStatsdClusterClient(confs map[string]*StatsdClientConfig) (
+	*StatsdClusterClient, error) {
+
+	cc := &StatsdClusterClient{clients: make(map[string]*StatsdNetClient)}
+	nodes := make([]string, 0, len(confs))
+	for node, conf := range confs {
+		client, err := NewStatsdNetClient(conf)
+		if err != nil {
+			cc.Close()
+			return nil, fmt.Errorf("statsd server '%s': %s", node, err)
+		}
+		cc.clients[node] = client
+		nodes = append(nodes, node)
+	}
+	var err error
+	if cc.ring, err = NewStatsdRing(nodes); err != nil {
+		cc.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// client returns the client of the server owning bucket, or nil if every
+// server is down.
+func (cc *StatsdClusterClient) client(bucket string) *StatsdNetClient {
+	node, ok := cc.ring.Node(bucket, func(node string) bool {
+		return cc.clients[node].Healthy()
+	})
+	if !ok {
+		return nil
+	}
+	return cc.clients[node]
+}
+
+func (cc *StatsdClusterClient) IncrementCounter(bucket string, n int64, tags ...string) {
+	if client := cc.client(bucket); client != nil {
+		client.IncrementCounter(bucket, n, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) IncrementSampledCounter(bucket string, n int64,
+	srate float32, tags ...string) {
+
+	if client := cc.client(bucket); client != nil {
+		client.IncrementSampledCounter(bucket, n, srate, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) SendTiming(bucket string, ms float64, tags ...string) {
+	if client := cc.client(bucket); client != nil {
+		client.SendTiming(bucket, ms, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) SendSampledTiming(bucket string, ms float64,
+	srate float32, tags ...string) {
+
+	if client := cc.client(bucket); client != nil {
+		client.SendSampledTiming(bucket, ms, srate, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) SetGauge(bucket string, value float64, tags ...string) {
+	if client := cc.client(bucket); client != nil {
+		client.SetGauge(bucket, value, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) AdjustGauge(bucket string, delta float64, tags ...string) {
+	if client := cc.client(bucket); client != nil {
+		client.AdjustGauge(bucket, delta, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) AddToSet(bucket string, member string, tags ...string) {
+	if client := cc.client(bucket); client != nil {
+		client.AddToSet(bucket, member, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) SendHistogram(bucket string, value float64,
+	tags ...string) {
+
+	if client := cc.client(bucket); client != nil {
+		client.SendHistogram(bucket, value, tags...)
+	}
+}
+
+func (cc *StatsdClusterClient) SendSampledHistogram(bucket string, value float64,
+	srate float32, tags ...string) {
+
+	if client := cc.client(bucket); client != nil {
+		client.SendSampledHistogram(bucket, value, srate, tags...)
+	}
+}
+
+// Flush flushes every server's client.
+func (cc *StatsdClusterClient) Flush() {
+	for _, client := range cc.clients {
+		client.Flush()
+	}
+}
+
+// Close flushes and closes every server's client, returning the first
+// error.
+func (cc *StatsdClusterClient) Close() (err error) {
+	for _, client := range cc.clients {
+		if e := client.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
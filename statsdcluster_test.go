@@ -0,0 +1,158 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func StatsdClusterSpec(c gs.Context) {
+	buckets := make([]string, 1000)
+	for i := range buckets {
+		buckets[i] = fmt.Sprintf("app.metric%d", i)
+	}
+
+	c.Specify("A StatsdRing", func() {
+		nodes := []string{"udp://10.0.0.1:8125", "udp://10.0.0.2:8125",
+			"udp://10.0.0.3:8125"}
+		ring, err := NewStatsdRing(nodes)
+		c.Assume(err, gs.IsNil)
+
+		owners := make(map[string]string)
+		for _, bucket := range buckets {
+			owners[bucket], _ = ring.Node(bucket, nil)
+		}
+
+		c.Specify("routes deterministically, whatever the node order", func() {
+			reordered, err := NewStatsdRing([]string{nodes[2], nodes[0], nodes[1]})
+			c.Assume(err, gs.IsNil)
+			for _, bucket := range buckets {
+				node, ok := reordered.Node(bucket, nil)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(node, gs.Equals, owners[bucket])
+			}
+			// changing the hash would move buckets between running nodes
+			node, _ := ring.Node("app.requests", nil)
+			c.Expect(node, gs.Equals, "udp://10.0.0.2:8125")
+		})
+
+		c.Specify("spreads buckets over every node", func() {
+			counts := make(map[string]int)
+			for _, node := range owners {
+				counts[node]++
+			}
+			for _, node := range nodes {
+				c.Expect(counts[node] > 200, gs.IsTrue)
+			}
+		})
+
+		c.Specify("only moves a down node's buckets, until it's back", func() {
+			down := nodes[1]
+			up := func(node string) bool { return node != down }
+			for _, bucket := range buckets {
+				node, ok := ring.Node(bucket, up)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(node, gs.Not(gs.Equals), down)
+				if owners[bucket] != down {
+					c.Expect(node, gs.Equals, owners[bucket])
+				}
+			}
+
+			down = ""
+			for _, bucket := range buckets {
+				node, _ := ring.Node(bucket, up)
+				c.Expect(node, gs.Equals, owners[bucket])
+			}
+
+			_, ok := ring.Node("app.requests", func(string) bool { return false })
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("rejects bad node lists", func() {
+			_, err := NewStatsdRing(nil)
+			c.Expect(err.Error(), gs.Equals, "statsd ring needs at least one node")
+			_, err = NewStatsdRing([]string{nodes[0], nodes[0]})
+			c.Expect(err.Error(), gs.Equals,
+				"statsd ring node listed twice: udp://10.0.0.1:8125")
+		})
+	})
+
+	c.Specify("A StatsdOutput with several urls", func() {
+		socks := make(map[string]net.PacketConn)
+		for i := 0; i < 2; i++ {
+			sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer sock.Close()
+			socks["udp://"+sock.LocalAddr().String()] = sock
+		}
+		receive := func(sock net.PacketConn) string {
+			buf := make([]byte, 1024)
+			sock.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := sock.ReadFrom(buf)
+			if err != nil {
+				return err.Error()
+			}
+			return string(buf[:n])
+		}
+
+		output := new(StatsdOutput)
+		config := output.ConfigStruct().(*StatsdOutputConfig)
+		for url := range socks {
+			config.Urls = append(config.Urls, url)
+		}
+
+		c.Specify("sends each bucket to its node", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer output.statsdClient.(*StatsdClusterClient).Close()
+			ring, err := NewStatsdRing(config.Urls)
+			c.Assume(err, gs.IsNil)
+			for _, bucket := range buckets[:20] {
+				output.statsdClient.IncrementCounter(bucket, 1)
+				node, _ := ring.Node(bucket, nil)
+				c.Expect(receive(socks[node]), gs.Equals, bucket+":1|c")
+			}
+		})
+
+		c.Specify("skips servers that are down", func() {
+			// a tcp port nothing listens on
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			deadUrl := "tcp://" + ln.Addr().String()
+			ln.Close()
+			config.Urls = append(config.Urls[:1], deadUrl)
+			config.ReconnectBackoffMin = "1h"
+			config.ReconnectBackoffMax = "1h"
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer output.statsdClient.(*StatsdClusterClient).Close()
+			for _, bucket := range buckets[:20] {
+				output.statsdClient.IncrementCounter(bucket, 1)
+				c.Expect(receive(socks[config.Urls[0]]), gs.Equals, bucket+":1|c")
+			}
+		})
+
+		c.Specify("rejects duplicate urls", func() {
+			config.Urls = append(config.Urls, config.Urls[0])
+			err := output.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"StatsdOutput url listed twice: "+config.Urls[0])
+		})
+	})
+}
@@ -16,17 +16,38 @@ package heka_mozsvc_plugins
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/plugins"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	"github.com/rafrombrc/gomock/gomock"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"io"
 	"io/ioutil"
 	"log"
 	"log/syslog"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"testing/quick"
 	"time"
+	"unicode/utf8"
 )
 
 func runPktSyslog(c net.PacketConn, done chan<- string) {
@@ -126,6 +147,273 @@ func startServer(n, la string, done chan<- string, crashy bool) (addr string,
 	return
 }
 
+// readOctetCounted reads a single RFC 6587 octet-counted frame.
+func readOctetCounted(b *bufio.Reader) (string, error) {
+	lenStr, err := b.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	msgLen, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, msgLen)
+	if _, err = io.ReadFull(b, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func startTlsServer(conf *tls.Config, done chan<- string) (addr string, sock io.Closer) {
+	l, e := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if e != nil {
+		log.Fatalf("startTlsServer failed: %v", e)
+	}
+	go runOctetCountedSyslog(l, done)
+	return l.Addr().String(), l
+}
+
+func startOctetCountedServer(done chan<- string) (addr string, sock io.Closer) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		log.Fatalf("startOctetCountedServer failed: %v", e)
+	}
+	go runOctetCountedSyslog(l, done)
+	return l.Addr().String(), l
+}
+
+func runOctetCountedSyslog(l net.Listener, done chan<- string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b := bufio.NewReader(c)
+			for {
+				s, err := readOctetCounted(b)
+				if err != nil {
+					return
+				}
+				done <- s
+			}
+		}(c)
+	}
+}
+
+type testCerts struct {
+	dir            string
+	caFile         string
+	certFile       string
+	keyFile        string
+	serverCertFile string
+	serverKeyFile  string
+	caPool         *x509.CertPool
+	serverCert     tls.Certificate
+}
+
+// makeTestCerts creates a self-signed CA and a server and client
+// certificate signed by it. The CA and both key pairs are written to a
+// temp directory, which the caller should remove.
+func makeTestCerts() *testCerts {
+	var err error
+	tc := new(testCerts)
+	if tc.dir, err = ioutil.TempDir("", "syslogtls"); err != nil {
+		log.Fatal("TempDir: ", err)
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "heka test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		log.Fatal("CreateCertificate: ", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDer)
+	tc.caPool = x509.NewCertPool()
+	tc.caPool.AddCert(caCert)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			log.Fatal("CreateCertificate: ", err)
+		}
+		keyDer, _ := x509.MarshalECPrivateKey(key)
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	}
+
+	certPem, keyPem := issue(2, x509.ExtKeyUsageServerAuth)
+	if tc.serverCert, err = tls.X509KeyPair(certPem, keyPem); err != nil {
+		log.Fatal("X509KeyPair: ", err)
+	}
+	tc.serverCertFile = filepath.Join(tc.dir, "server.pem")
+	tc.serverKeyFile = filepath.Join(tc.dir, "server.key")
+	ioutil.WriteFile(tc.serverCertFile, certPem, 0600)
+	ioutil.WriteFile(tc.serverKeyFile, keyPem, 0600)
+
+	certPem, keyPem = issue(3, x509.ExtKeyUsageClientAuth)
+	tc.caFile = filepath.Join(tc.dir, "ca.pem")
+	tc.certFile = filepath.Join(tc.dir, "client.pem")
+	tc.keyFile = filepath.Join(tc.dir, "client.key")
+	ioutil.WriteFile(tc.caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0600)
+	ioutil.WriteFile(tc.certFile, certPem, 0600)
+	ioutil.WriteFile(tc.keyFile, keyPem, 0600)
+	return tc
+}
+
+// blockingConn is a syslogServerConn that stalls every write until
+// released, to exercise the SyslogWriter queue.
+type blockingConn struct {
+	started chan string
+	release chan struct{}
+	mu      sync.Mutex
+	written []string
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{
+		started: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingConn) writeString(format, tsLayout string, msg *SyslogMsg) (int, error) {
+	b.started <- msg.payload
+	<-b.release
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.written = append(b.written, msg.payload)
+	return len(msg.payload), nil
+}
+
+func (b *blockingConn) close() error {
+	return nil
+}
+
+// failingConn is a syslogServerConn whose writes fail once it has written
+// ok messages, to simulate a collector going away mid-message.
+type failingConn struct {
+	ok      int
+	written []string
+}
+
+func (f *failingConn) writeString(format, tsLayout string, msg *SyslogMsg) (int, error) {
+	if len(f.written) >= f.ok {
+		return 0, errors.New("broken pipe")
+	}
+	f.written = append(f.written, msg.payload)
+	return len(msg.payload), nil
+}
+
+func (f *failingConn) close() error {
+	return nil
+}
+
+// breakAfter swaps the connection of a writer's only destination for a
+// failingConn writing ok messages. The writer's collector must be gone, so
+// reconnecting fails too.
+func breakAfter(w *SyslogWriter, ok int) *failingConn {
+	fc := &failingConn{ok: ok}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dests[0].conn.close()
+	w.dests[0].conn = fc
+	return fc
+}
+
+// killableServer is a unix stream syslog listener that can be shut down
+// along with all of its connections, to simulate a collector dying.
+type killableServer struct {
+	addr  string
+	done  chan string
+	l     net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startKillableServer(addr string) *killableServer {
+	if addr == "" {
+		f, err := ioutil.TempFile("", "syslogtest")
+		if err != nil {
+			log.Fatal("TempFile: ", err)
+		}
+		f.Close()
+		addr = f.Name()
+	}
+	os.Remove(addr)
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		log.Fatalf("startKillableServer failed: %v", err)
+	}
+	s := &killableServer{addr: addr, done: make(chan string, 100), l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go func(c net.Conn) {
+				b := bufio.NewReader(c)
+				for {
+					line, err := b.ReadString('\n')
+					if err != nil {
+						return
+					}
+					s.done <- line
+				}
+			}(c)
+		}
+	}()
+	return s
+}
+
+func (s *killableServer) kill() {
+	s.l.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// received returns how many messages arrived within a short wait.
+func (s *killableServer) received() (ct int) {
+	for {
+		select {
+		case <-s.done:
+			ct++
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
 func SyslogWriterSpec(c gs.Context) {
 
 	prefix := "syslog_test"
@@ -262,6 +550,1351 @@ func SyslogWriterSpec(c gs.Context) {
 		}
 	})
 
+	c.Specify("TestFormats", func() {
+		tests := []struct {
+			format string
+			exp    string
+		}{
+			{SYSLOG_FORMAT_LEGACY, `^<11>\d{4}-\d\d-\d\dT\S+ %s syslog_test\[%d\]: format test\n$`},
+			{SYSLOG_FORMAT_RFC3164, `^<11>[A-Z][a-z]{2} [ 1-3]\d \d\d:\d\d:\d\d %s syslog_test\[%d\]: format test\n$`},
+			{SYSLOG_FORMAT_RFC5424, `^<11>1 \d{4}-\d\d-\d\dT\S+ %s syslog_test %d - - format test\n$`},
+		}
+
+		hostname, err := os.Hostname()
+		c.Assume(err, gs.IsNil)
+		for _, test := range tests {
+			done := make(chan string)
+			addr, sock, _ := startServer("udp", "", done, crashy)
+			defer sock.Close()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "udp", Raddr: addr,
+				Format: test.format})
+			c.Expect(err, gs.IsNil)
+			_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_ERR, prefix, "format test")
+			c.Expect(err, gs.IsNil)
+			exp := fmt.Sprintf(test.exp, regexp.QuoteMeta(hostname), os.Getpid())
+			rcvd := <-done
+			c.Expect(regexp.MustCompile(exp).MatchString(rcvd), gs.IsTrue)
+			w.Close()
+		}
+
+		_, err = NewSyslogWriter(&SyslogWriterConfig{Network: "udp", Raddr: "127.0.0.1:514",
+			Format: "rfc9999"})
+		c.Expect(err.Error(), gs.Equals, "unknown syslog format: rfc9999")
+	})
+
+	c.Specify("TestStructuredData", func() {
+		c.Expect(formatStructuredData(nil), gs.Equals, "-")
+
+		sd := []SyslogSDElement{
+			{"exampleSDID@32473", []SyslogSDParam{
+				{"iut", "3"},
+				{"eventSource", "Application"},
+			}},
+			{"escapes@32473", []SyslogSDParam{
+				{"quote", `say "hi"`},
+				{"bracket", "a]b"},
+				{"slash", `c:\tmp`},
+				{"bad name=", "x"},
+			}},
+		}
+		c.Expect(formatStructuredData(sd), gs.Equals,
+			`[exampleSDID@32473 iut="3" eventSource="Application"]`+
+				`[escapes@32473 quote="say \"hi\"" bracket="a\]b" slash="c:\\tmp" bad_name_="x"]`)
+
+		done := make(chan string)
+		addr, sock, _ := startServer("udp", "", done, crashy)
+		defer sock.Close()
+		w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "udp", Raddr: addr,
+			Format: SYSLOG_FORMAT_RFC5424})
+		c.Assume(err, gs.IsNil)
+		msg := &SyslogMsg{
+			priority:       syslog.LOG_USER | syslog.LOG_INFO,
+			prefix:         "syslog test",
+			payload:        "sd test",
+			msgId:          "ID47",
+			structuredData: sd[:1],
+		}
+		_, err = w.WriteMsg(msg)
+		c.Expect(err, gs.IsNil)
+		rcvd := <-done
+		exp := fmt.Sprintf(` syslog_test %d ID47 [exampleSDID@32473 iut="3" eventSource="Application"] sd test
+`, os.Getpid())
+		c.Expect(strings.HasSuffix(rcvd, exp), gs.IsTrue)
+		w.Close()
+	})
+
+	c.Specify("A CefOutput", func() {
+		output := new(CefOutput)
+		config := output.ConfigStruct().(*CefOutputConfig)
+		config.Network = "udp"
+		config.Raddr = "127.0.0.1:514"
+		config.StructuredData = map[string][]string{
+			"origin":     {"ip"},
+			"cef@32473":  {"src", "dpt"},
+			"none@32473": {"missing"},
+		}
+
+		c.Specify("rejects invalid durations", func() {
+			config.StructuredData = nil
+			config.WriteTimeout = "soon"
+			err := output.Init(config)
+			c.Expect(strings.HasPrefix(err.Error(),
+				"CefOutput invalid write_timeout 'soon': "), gs.IsTrue)
+		})
+
+		c.Specify("requires rfc5424 for structured data", func() {
+			err := output.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"CefOutput structured_data requires the rfc5424 format")
+		})
+
+		c.Specify("builds structured data from message fields", func() {
+			config.Format = SYSLOG_FORMAT_RFC5424
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer output.syslogWriter.Close()
+
+			pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			for _, f := range []struct {
+				name  string
+				value interface{}
+			}{{"src", "10.0.0.1"}, {"dpt", 443}, {"ip", "192.0.2.1"}, {"ip", "192.0.2.2"}} {
+				field, _ := message.NewField(f.name, f.value, "")
+				pack.Message.AddField(field)
+			}
+			c.Expect(formatStructuredData(output.structuredData(pack)), gs.Equals,
+				`[cef@32473 src="10.0.0.1" dpt="443"][origin ip="192.0.2.1" ip="192.0.2.2"]`)
+		})
+
+		c.Specify("reports its queue counters", func() {
+			config.StructuredData = nil
+			config.QueueSize = 5
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer output.syslogWriter.Close()
+
+			msg := new(message.Message)
+			c.Expect(output.ReportMsg(msg), gs.IsNil)
+			for _, name := range []string{"QueueDepth", "DroppedMessages", "FailedWrites",
+				"ReconnectAttempts", "OversizedMessages", "UnknownMetaValues"} {
+				val, ok := msg.GetFieldValue(name)
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(val, gs.Equals, int64(0))
+			}
+			val, _ := msg.GetFieldValue("LastError")
+			c.Expect(val, gs.Equals, "")
+		})
+
+		c.Specify("uses the message's hostname and timestamp", func() {
+			done := make(chan string)
+			addr, sock, _ := startServer("udp", "", done, crashy)
+			defer sock.Close()
+
+			config.StructuredData = nil
+			config.Raddr = addr
+			config.Format = SYSLOG_FORMAT_RFC5424
+			config.Hostname = "override.example.com"
+			config.UseMessageHostname = true
+			config.UseMessageTimestamp = true
+			config.TimestampPrecision = SYSLOG_TIMESTAMP_MILLISECONDS
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			ctrl := gomock.NewController(new(pipeline_ts.SimpleT))
+			defer ctrl.Finish()
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			inChan := make(chan *pipeline.PipelinePack, 2)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(nil)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).Times(2)
+
+			ts := time.Date(2014, 3, 5, 11, 22, 33, 456789000, time.UTC)
+			pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			pack.Message.SetHostname("web1.example.com")
+			pack.Message.SetTimestamp(ts.UnixNano())
+			pack.Message.SetPayload("from message")
+			inChan <- pack
+			// Without a hostname in the message the configured one is used.
+			pack = pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			pack.Message.SetPayload("from config")
+			inChan <- pack
+			close(inChan)
+			output.Run(oth.MockOutputRunner, oth.MockHelper)
+
+			lines := strings.SplitAfter(<-done, "\n")
+			c.Assume(len(lines), gs.Equals, 3)
+			exp := fmt.Sprintf("<166>1 %s web1.example.com heka_no_ident %d - - from message\n",
+				ts.Local().Format("2006-01-02T15:04:05.000Z07:00"), os.Getpid())
+			c.Expect(lines[0], gs.Equals, exp)
+			c.Expect(strings.Contains(lines[1], " override.example.com heka_no_ident "),
+				gs.IsTrue)
+		})
+
+		c.Specify("doesn't retry messages partly written", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			config.StructuredData = nil
+			config.Network = "tcp"
+			config.Raddr = l.Addr().String()
+			config.MaxMessageSize = 100
+			config.OversizePolicy = SYSLOG_OVERSIZE_FRAGMENT
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			l.Close()
+			fc := breakAfter(output.syslogWriter, 1)
+
+			ctrl := gomock.NewController(new(pipeline_ts.SimpleT))
+			defer ctrl.Finish()
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			inChan := make(chan *pipeline.PipelinePack, 1)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(nil)
+			// The cursor moves past the message, so it isn't retried.
+			oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any())
+
+			pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			pack.Message.SetPayload(strings.Repeat("x", 500))
+			inChan <- pack
+			close(inChan)
+			output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(len(fc.written), gs.Equals, 1)
+		})
+
+		c.Specify("sets the MSGID", func() {
+			done := make(chan string)
+			addr, sock, _ := startServer("udp", "", done, crashy)
+			defer sock.Close()
+
+			config.StructuredData = nil
+			config.Raddr = addr
+			config.MsgId = "CEF"
+			config.MsgIdField = "event_id"
+			err := output.Init(config)
+			c.Expect(err.Error(), gs.Equals, "CefOutput msgid requires the rfc5424 format")
+			config.Format = SYSLOG_FORMAT_RFC5424
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			ctrl := gomock.NewController(new(pipeline_ts.SimpleT))
+			defer ctrl.Finish()
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			inChan := make(chan *pipeline.PipelinePack, 2)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(nil)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).Times(2)
+
+			pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			field, _ := message.NewField("event_id", "LOGIN", "")
+			pack.Message.AddField(field)
+			pack.Message.SetPayload("from field")
+			inChan <- pack
+			// Without the field the configured MSGID is used.
+			pack = pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+			pack.Message.SetPayload("from config")
+			inChan <- pack
+			close(inChan)
+			output.Run(oth.MockOutputRunner, oth.MockHelper)
+
+			lines := strings.SplitAfter(<-done, "\n")
+			c.Assume(len(lines), gs.Equals, 3)
+			pid := fmt.Sprintf(" heka_no_ident %d ", os.Getpid())
+			c.Expect(strings.HasSuffix(lines[0], pid+"LOGIN - from field\n"), gs.IsTrue)
+			c.Expect(strings.HasSuffix(lines[1], pid+"CEF - from config\n"), gs.IsTrue)
+		})
+
+		c.Specify("renders CEF records from message fields", func() {
+			config.StructuredData = nil
+			config.EventFormat = "cef"
+			config.Cef.SignatureId = "login"
+			config.Cef.Extensions = map[string]string{"suser": "user"}
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer output.syslogWriter.Close()
+
+			msg := newCefTestMessage(map[string]interface{}{"user": "alice"})
+			c.Expect(output.formatter.Format(msg), gs.Equals,
+				"CEF:0|Mozilla|Heka||login||Unknown|suser=alice")
+
+			config.EventFormat = "xml"
+			err = output.Init(config)
+			c.Expect(err.Error(), gs.Equals, "CefOutput unknown event_format: xml")
+		})
+
+		c.Specify("uses the configured encoder", func() {
+			done := make(chan string)
+			addr, sock, _ := startServer("udp", "", done, crashy)
+			defer sock.Close()
+
+			config.StructuredData = nil
+			config.Raddr = addr
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			ctrl := gomock.NewController(new(pipeline_ts.SimpleT))
+			defer ctrl.Finish()
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			encoder := new(plugins.PayloadEncoder)
+			encoder.Init(new(plugins.PayloadEncoderConfig))
+			inChan := make(chan *pipeline.PipelinePack, 3)
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(encoder)
+			gomock.InOrder(
+				oth.MockOutputRunner.EXPECT().Encode(gomock.Any()).Return(
+					[]byte("encoded line\n"), nil),
+				oth.MockOutputRunner.EXPECT().Encode(gomock.Any()).Return(nil, nil),
+				oth.MockOutputRunner.EXPECT().Encode(gomock.Any()).Return(
+					nil, errors.New("bad message")),
+			)
+			oth.MockOutputRunner.EXPECT().UpdateCursor(gomock.Any()).Times(3)
+
+			for i := 0; i < 3; i++ {
+				pack := pipeline.NewPipelinePack(make(chan *pipeline.PipelinePack, 1))
+				pack.Message.SetPayload("raw payload")
+				for name, value := range map[string]string{
+					"cef_meta.syslog_priority": "ERR",
+					"cef_meta.syslog_facility": "AUTH",
+					"cef_meta.syslog_ident":    "encoded",
+				} {
+					field, _ := message.NewField(name, value, "")
+					pack.Message.AddField(field)
+				}
+				inChan <- pack
+			}
+			close(inChan)
+			c.Expect(output.Run(oth.MockOutputRunner, oth.MockHelper), gs.IsNil)
+
+			exp := fmt.Sprintf(" encoded[%d]: encoded line\n", os.Getpid())
+			rcvd := <-done
+			c.Expect(strings.HasPrefix(rcvd, "<35>"), gs.IsTrue)
+			c.Expect(strings.HasSuffix(rcvd, exp), gs.IsTrue)
+			c.Expect(strings.Count(rcvd, "\n"), gs.Equals, 1)
+		})
+
+		c.Specify("won't combine an encoder with an event format", func() {
+			config.StructuredData = nil
+			config.EventFormat = CEF_EVENT_FORMAT_CEF
+			config.QueueSize = 10
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			ctrl := gomock.NewController(new(pipeline_ts.SimpleT))
+			defer ctrl.Finish()
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			oth.MockOutputRunner.EXPECT().Encoder().Return(new(plugins.PayloadEncoder))
+			err = output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err.Error(), gs.Equals,
+				"CefOutput can't use an encoder with the cef or leef event_format")
+			// The writer is closed, so its sender has stopped.
+			stopped := false
+			select {
+			case <-output.syslogWriter.senderDone:
+				stopped = true
+			case <-time.After(time.Second):
+			}
+			c.Expect(stopped, gs.IsTrue)
+		})
+
+		c.Specify("resolves syslog metadata", func() {
+			config.StructuredData = nil
+			config.Facility = "local1"
+			config.Priority = "NOTICE"
+			config.Ident = "cef"
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer output.syslogWriter.Close()
+
+			ctrl := gomock.NewController(new(pipeline_ts.SimpleT))
+			defer ctrl.Finish()
+			oth := plugins_ts.NewOutputTestHelper(ctrl)
+			msg := new(message.Message)
+			msg.SetSeverity(3)
+			addMeta := func(name, value string) {
+				field, _ := message.NewField("cef_meta.syslog_"+name, value, "")
+				msg.AddField(field)
+			}
+
+			c.Specify("from the configured defaults", func() {
+				p, ident := output.syslogMeta(msg, oth.MockOutputRunner)
+				c.Expect(p, gs.Equals, syslog.LOG_LOCAL1|syslog.LOG_NOTICE)
+				c.Expect(ident, gs.Equals, "cef")
+			})
+
+			c.Specify("from the cef_meta fields", func() {
+				addMeta("priority", "err")
+				addMeta("facility", "AUTH")
+				addMeta("ident", "sshd")
+				p, ident := output.syslogMeta(msg, oth.MockOutputRunner)
+				c.Expect(p, gs.Equals, syslog.LOG_AUTH|syslog.LOG_ERR)
+				c.Expect(ident, gs.Equals, "sshd")
+			})
+
+			c.Specify("from the message severity", func() {
+				config.UseMessageSeverity = true
+				config.SeverityMap["3"] = "CRIT"
+				err = output.Init(config)
+				c.Assume(err, gs.IsNil)
+				p, _ := output.syslogMeta(msg, oth.MockOutputRunner)
+				c.Expect(p, gs.Equals, syslog.LOG_LOCAL1|syslog.LOG_CRIT)
+
+				// Unmapped severities use the default priority, and the
+				// cef_meta field still wins.
+				msg.SetSeverity(9)
+				p, _ = output.syslogMeta(msg, oth.MockOutputRunner)
+				c.Expect(p, gs.Equals, syslog.LOG_LOCAL1|syslog.LOG_NOTICE)
+				addMeta("priority", "DEBUG")
+				p, _ = output.syslogMeta(msg, oth.MockOutputRunner)
+				c.Expect(p, gs.Equals, syslog.LOG_LOCAL1|syslog.LOG_DEBUG)
+			})
+
+			c.Specify("reporting unknown cef_meta values", func() {
+				addMeta("priority", "LOUD")
+				addMeta("facility", "KITCHEN")
+				oth.MockOutputRunner.EXPECT().LogError(errors.New(
+					"unknown cef_meta.syslog_priority value 'LOUD', using the default"))
+				oth.MockOutputRunner.EXPECT().LogError(errors.New(
+					"unknown cef_meta.syslog_facility value 'KITCHEN', using the default"))
+				p, _ := output.syslogMeta(msg, oth.MockOutputRunner)
+				c.Expect(p, gs.Equals, syslog.LOG_LOCAL1|syslog.LOG_NOTICE)
+
+				report := new(message.Message)
+				output.ReportMsg(report)
+				val, _ := report.GetFieldValue("UnknownMetaValues")
+				c.Expect(val, gs.Equals, int64(2))
+			})
+		})
+
+		c.Specify("rejects invalid syslog metadata defaults", func() {
+			config.StructuredData = nil
+			config.Facility = "KITCHEN"
+			err := output.Init(config)
+			c.Expect(err.Error(), gs.Equals, "CefOutput unknown facility: KITCHEN")
+
+			config.Facility = "LOCAL4"
+			config.UseMessageSeverity = true
+			config.SeverityMap = map[string]string{"high": "ERR"}
+			err = output.Init(config)
+			c.Expect(err.Error(), gs.Equals,
+				"CefOutput invalid severity_map severity: high")
+		})
+
+		c.Specify("rejects an unknown timestamp precision", func() {
+			config.StructuredData = nil
+			config.TimestampPrecision = "ns"
+			err := output.Init(config)
+			c.Expect(err.Error(), gs.Equals, "unknown syslog timestamp precision: ns")
+		})
+	})
+
+	c.Specify("TestParse", func() {
+		ts := time.Date(2014, 3, 5, 11, 22, 33, 456000000, time.Local)
+		msg := &SyslogMsg{priority: syslog.LOG_LOCAL4 | syslog.LOG_NOTICE,
+			prefix: "app", payload: "parse test", hostname: "host", timestamp: ts,
+			msgId: "ID47", structuredData: []SyslogSDElement{
+				{"escapes@32473", []SyslogSDParam{{"quote", `say "hi" [now]`}}},
+				{"empty@32473", nil},
+			}}
+		layout := syslogTimestampLayouts[SYSLOG_TIMESTAMP_MILLISECONDS]
+
+		for _, format := range []string{SYSLOG_FORMAT_LEGACY, SYSLOG_FORMAT_RFC3164,
+			SYSLOG_FORMAT_RFC5424} {
+
+			line, err := formatSyslogMsg(format, layout, msg)
+			c.Assume(err, gs.IsNil)
+			parsed, err := ParseSyslogMsg(line)
+			c.Assume(err, gs.IsNil)
+			c.Expect(parsed.format, gs.Equals, format)
+			c.Expect(parsed.priority, gs.Equals, msg.priority)
+			c.Expect(parsed.hostname, gs.Equals, "host")
+			c.Expect(parsed.prefix, gs.Equals, "app")
+			c.Expect(parsed.pid, gs.Equals, os.Getpid())
+			c.Expect(parsed.payload, gs.Equals, "parse test")
+			if format == SYSLOG_FORMAT_RFC3164 {
+				// No year in RFC 3164 timestamps.
+				c.Expect(parsed.timestamp.Format(time.Stamp), gs.Equals,
+					ts.Format(time.Stamp))
+				continue
+			}
+			c.Expect(parsed.timestamp.Equal(ts), gs.IsTrue)
+			if format == SYSLOG_FORMAT_RFC5424 {
+				c.Expect(parsed.msgId, gs.Equals, "ID47")
+				c.Expect(formatStructuredData(parsed.structuredData), gs.Equals,
+					formatStructuredData(msg.structuredData))
+			}
+		}
+
+		// Hostnames and tags with spaces or tag delimiters still parse.
+		hostile := *msg
+		hostile.hostname = "web 1"
+		hostile.prefix = "my app: v2 [beta] " + strings.Repeat("x", 40)
+		for _, format := range []string{SYSLOG_FORMAT_LEGACY, SYSLOG_FORMAT_RFC3164} {
+			line, err := formatSyslogMsg(format, layout, &hostile)
+			c.Assume(err, gs.IsNil)
+			parsed, err := ParseSyslogMsg(line)
+			c.Assume(err, gs.IsNil)
+			c.Expect(parsed.hostname, gs.Equals, "web_1")
+			c.Expect(parsed.prefix, gs.Equals, "my_app__v2__beta__xxxxxxxxxxxxxx")
+			c.Expect(parsed.pid, gs.Equals, os.Getpid())
+			c.Expect(parsed.payload, gs.Equals, "parse test")
+		}
+
+		// Only a timestamp starts a BSD header, and only text ending in
+		// a colon, or a pid and a colon, is a tag.
+		bsdTests := []struct {
+			line     string
+			hostname string
+			prefix   string
+			pid      int
+			payload  string
+		}{
+			{"<13>hello world", "", "", 0, "hello world"},
+			{"<13>app[12]: no timestamp", "", "", 0, "app[12]: no timestamp"},
+			{"<13>2015-01-02T15:04:05Z host my app[12]: hi", "host", "my app", 12, "hi"},
+			{"<13>2015-01-02T15:04:05Z host app: hi", "host", "app", 0, "hi"},
+			{"<13>Mar  5 11:22:33 app[7]: local", "", "app", 7, "local"},
+			{"<13>Mar  5 11:22:33 host CEF:0|v|p", "host", "", 0, "CEF:0|v|p"},
+			{"<13>Mar  5 11:22:33 host user logged in: alice", "host", "", 0,
+				"user logged in: alice"},
+		}
+		for _, test := range bsdTests {
+			parsed, err := ParseSyslogMsg(test.line)
+			c.Assume(err, gs.IsNil)
+			c.Expect(parsed.hostname, gs.Equals, test.hostname)
+			c.Expect(parsed.prefix, gs.Equals, test.prefix)
+			c.Expect(parsed.pid, gs.Equals, test.pid)
+			c.Expect(parsed.payload, gs.Equals, test.payload)
+		}
+
+		parsed, err := ParseSyslogMsg("<13>1 - - - - - -")
+		c.Assume(err, gs.IsNil)
+		c.Expect(parsed.timestamp.IsZero(), gs.IsTrue)
+		c.Expect(parsed.hostname, gs.Equals, "")
+		c.Expect(parsed.payload, gs.Equals, "")
+
+		for line, exp := range map[string]string{
+			"no priority":               "missing syslog priority",
+			"<192>too high":             "invalid syslog priority: 192",
+			"<13>1 yesterday h a - - -": "invalid syslog timestamp: yesterday",
+			`<13>1 - h a - - [id p="x`:  "unterminated syslog SD-PARAM value",
+		} {
+			_, err = ParseSyslogMsg(line)
+			c.Expect(err.Error(), gs.Equals, exp)
+		}
+	})
+
+	c.Specify("TestTimestampPrecision", func() {
+		ts := time.Date(2014, 3, 5, 11, 22, 33, 456789000, time.UTC)
+		msg := &SyslogMsg{priority: syslog.LOG_USER | syslog.LOG_INFO,
+			prefix: "app", payload: "ts test", hostname: "host", timestamp: ts}
+		tests := []struct {
+			precision string
+			exp       string
+		}{
+			{SYSLOG_TIMESTAMP_SECONDS, "2014-03-05T11:22:33Z"},
+			{SYSLOG_TIMESTAMP_MILLISECONDS, "2014-03-05T11:22:33.456Z"},
+			{SYSLOG_TIMESTAMP_MICROSECONDS, "2014-03-05T11:22:33.456789Z"},
+		}
+		for _, test := range tests {
+			layout := syslogTimestampLayouts[test.precision]
+			line, err := formatSyslogMsg(SYSLOG_FORMAT_RFC5424, layout, msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(line, gs.Equals, fmt.Sprintf("<14>1 %s host app %d - - ts test",
+				test.exp, os.Getpid()))
+			line, err = formatSyslogMsg(SYSLOG_FORMAT_LEGACY, layout, msg)
+			c.Expect(err, gs.IsNil)
+			c.Expect(line, gs.Equals, fmt.Sprintf("<14>%s host app[%d]: ts test",
+				test.exp, os.Getpid()))
+		}
+		line, err := formatSyslogMsg(SYSLOG_FORMAT_RFC3164,
+			syslogTimestampLayouts[SYSLOG_TIMESTAMP_MICROSECONDS], msg)
+		c.Expect(err, gs.IsNil)
+		c.Expect(line, gs.Equals, fmt.Sprintf("<14>Mar  5 11:22:33 host app[%d]: ts test",
+			os.Getpid()))
+	})
+
+	c.Specify("TestTls", func() {
+		certs := makeTestCerts()
+		defer os.RemoveAll(certs.dir)
+
+		serverConf := &tls.Config{
+			Certificates: []tls.Certificate{certs.serverCert},
+			ClientCAs:    certs.caPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		done := make(chan string)
+		addr, sock := startTlsServer(serverConf, done)
+		defer sock.Close()
+
+		tlsConf := &TlsConfig{
+			CertFile: certs.certFile,
+			KeyFile:  certs.keyFile,
+			RootCAs:  certs.caFile,
+		}
+
+		c.Specify("writes octet-counted messages with a client certificate", func() {
+			goConf, err := CreateGoTlsConfig(tlsConf)
+			c.Assume(err, gs.IsNil)
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tls", Raddr: addr,
+				TlsConfig: goConf})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+
+			for _, msg := range []string{"tls test", "multi\nline"} {
+				_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, msg)
+				c.Expect(err, gs.IsNil)
+				exp := fmt.Sprintf(" syslog_test[%d]: %s", os.Getpid(), msg)
+				rcvd := <-done
+				c.Expect(strings.HasSuffix(rcvd, exp), gs.IsTrue)
+			}
+		})
+
+		c.Specify("verifies the server name", func() {
+			tlsConf.ServerName = "syslog.example.com"
+			goConf, err := CreateGoTlsConfig(tlsConf)
+			c.Assume(err, gs.IsNil)
+			_, err = NewSyslogWriter(&SyslogWriterConfig{Network: "tls", Raddr: addr,
+				TlsConfig: goConf})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("enforces the minimum TLS version", func() {
+			serverConf.MaxVersion = tls.VersionTLS12
+			tlsConf.MinVersion = "TLS13"
+			goConf, err := CreateGoTlsConfig(tlsConf)
+			c.Assume(err, gs.IsNil)
+			_, err = NewSyslogWriter(&SyslogWriterConfig{Network: "tls", Raddr: addr,
+				TlsConfig: goConf})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects bad settings", func() {
+			_, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tls", Raddr: addr})
+			c.Expect(err.Error(), gs.Equals, "the tls network requires a TLS config")
+
+			_, err = CreateGoTlsConfig(&TlsConfig{MinVersion: "SSL3"})
+			c.Expect(err.Error(), gs.Equals, "unknown TLS min_version: SSL3")
+
+			_, err = CreateGoTlsConfig(&TlsConfig{CertFile: certs.certFile})
+			c.Expect(err.Error(), gs.Equals,
+				"TLS cert_file and key_file must be set together")
+		})
+	})
+
+	c.Specify("TestFraming", func() {
+		msg := "first line\r\nsecond line"
+
+		c.Specify("octet-counting keeps multi-line messages together", func() {
+			done := make(chan string)
+			addr, sock := startOctetCountedServer(done)
+			defer sock.Close()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp", Raddr: addr,
+				Framing: SYSLOG_FRAMING_OCTET_COUNTING})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			for i := 0; i < 2; i++ {
+				_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, msg)
+				c.Expect(err, gs.IsNil)
+				rcvd := <-done
+				c.Expect(strings.HasSuffix(rcvd, "]: "+msg), gs.IsTrue)
+			}
+		})
+
+		c.Specify("newline framing", func() {
+			done := make(chan string)
+			addr, sock, _ := startServer("tcp", "", done, crashy)
+			defer sock.Close()
+
+			tests := []struct {
+				newlines string
+				exp      string
+			}{
+				{SYSLOG_NEWLINES_ESCAPE, `]: first line\r\nsecond line` + "\n"},
+				{SYSLOG_NEWLINES_STRIP, "]: first linesecond line\n"},
+				{SYSLOG_NEWLINES_KEEP, "]: first line\r\n"},
+			}
+			for _, test := range tests {
+				w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp", Raddr: addr,
+					Newlines: test.newlines})
+				c.Assume(err, gs.IsNil)
+				_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, msg+"\n")
+				c.Expect(err, gs.IsNil)
+				rcvd := <-done
+				c.Expect(strings.HasSuffix(rcvd, test.exp), gs.IsTrue)
+				w.Close()
+			}
+			// the rest of the kept message arrives as a separate line
+			c.Expect(<-done, gs.Equals, "second line\n")
+		})
+
+		c.Specify("rejects bad settings", func() {
+			tests := []struct {
+				conf *SyslogWriterConfig
+				err  string
+			}{
+				{&SyslogWriterConfig{Network: "udp", Framing: SYSLOG_FRAMING_OCTET_COUNTING},
+					"octet-counting framing requires a stream network, not 'udp'"},
+				{&SyslogWriterConfig{Network: "tls", TlsConfig: &tls.Config{},
+					Framing: SYSLOG_FRAMING_NEWLINE},
+					"the tls network requires octet-counting framing"},
+				{&SyslogWriterConfig{Network: "tcp", Framing: "cobs"},
+					"unknown syslog framing: cobs"},
+				{&SyslogWriterConfig{Network: "tcp", Newlines: "fold"},
+					"unknown syslog newline handling: fold"},
+			}
+			for _, test := range tests {
+				_, err := NewSyslogWriter(test.conf)
+				c.Expect(err.Error(), gs.Equals, test.err)
+			}
+		})
+	})
+
+	c.Specify("TestMessageSize", func() {
+		done := make(chan string)
+		addr, sock := startOctetCountedServer(done)
+		defer sock.Close()
+		newWriter := func(maxSize int, policy string) *SyslogWriter {
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp", Raddr: addr,
+				Framing: SYSLOG_FRAMING_OCTET_COUNTING, Format: SYSLOG_FORMAT_RFC5424,
+				MaxMessageSize: maxSize, OversizePolicy: policy})
+			c.Assume(err, gs.IsNil)
+			return w
+		}
+		payload := strings.Repeat("é", 100)
+
+		c.Specify("sends messages that fit as is", func() {
+			w := newWriter(1000, SYSLOG_OVERSIZE_REJECT)
+			defer w.Close()
+			_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+			c.Expect(err, gs.IsNil)
+			c.Expect(strings.HasSuffix(<-done, " - "+payload), gs.IsTrue)
+			c.Expect(w.Stats().Oversized, gs.Equals, int64(0))
+		})
+
+		c.Specify("truncates with a marker", func() {
+			w := newWriter(100, SYSLOG_OVERSIZE_TRUNCATE)
+			defer w.Close()
+			_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+			c.Expect(err, gs.IsNil)
+			rcvd := <-done
+			c.Expect(len(rcvd) <= 100, gs.IsTrue)
+			c.Expect(strings.HasSuffix(rcvd, "é"+SYSLOG_TRUNCATION_MARKER), gs.IsTrue)
+			c.Expect(utf8.ValidString(rcvd), gs.IsTrue)
+			c.Expect(w.Stats().Oversized, gs.Equals, int64(1))
+		})
+
+		c.Specify("splits into numbered fragments", func() {
+			w := newWriter(100, SYSLOG_OVERSIZE_FRAGMENT)
+			defer w.Close()
+			_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+			c.Expect(err, gs.IsNil)
+
+			first := <-done
+			i := strings.Index(first, " - [1/")
+			c.Assume(i > 0, gs.IsTrue)
+			var total int
+			fmt.Sscanf(first[i+6:], "%d]", &total)
+			c.Expect(total > 1, gs.IsTrue)
+			rcvd := []string{first}
+			for len(rcvd) < total {
+				rcvd = append(rcvd, <-done)
+			}
+			joined := ""
+			for n, frag := range rcvd {
+				c.Expect(len(frag) <= 100, gs.IsTrue)
+				marker := fmt.Sprintf(" - "+SYSLOG_FRAGMENT_PREFIX, n+1, total)
+				parts := strings.SplitN(frag, marker, 2)
+				c.Assume(len(parts), gs.Equals, 2)
+				joined += parts[1]
+			}
+			c.Expect(joined, gs.Equals, payload)
+			c.Expect(w.Stats().Oversized, gs.Equals, int64(1))
+		})
+
+		c.Specify("won't have a message resent after writing some fragments", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp",
+				Raddr: l.Addr().String(), MaxMessageSize: 100,
+				OversizePolicy: SYSLOG_OVERSIZE_FRAGMENT})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			l.Close()
+			fc := breakAfter(w, 1)
+
+			_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+			partial, ok := err.(*SyslogPartialWriteError)
+			c.Assume(ok, gs.IsTrue)
+			c.Expect(partial.Written, gs.Equals, 1)
+			c.Expect(partial.Total > 1, gs.IsTrue)
+			c.Expect(len(fc.written), gs.Equals, 1)
+
+			// A failure on the first fragment can be retried as usual.
+			w.mu.Lock()
+			w.dests[0].retryAt = time.Time{}
+			w.mu.Unlock()
+			_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+			_, ok = err.(*SyslogPartialWriteError)
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("widens the fragment numbers as needed", func() {
+			frags := fragmentPayload(strings.Repeat("x", 100), 13)
+			c.Expect(len(frags), gs.Equals, 20)
+			c.Expect(frags[0], gs.Equals, "[1/20] xxxxx")
+			c.Expect(frags[19], gs.Equals, "[20/20] xxxxx")
+			c.Expect(fragmentPayload("xxx", 9), gs.IsNil)
+		})
+
+		c.Specify("rejects oversized messages", func() {
+			w := newWriter(100, SYSLOG_OVERSIZE_REJECT)
+			defer w.Close()
+			_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+			oversize, ok := err.(*SyslogOversizeError)
+			c.Assume(ok, gs.IsTrue)
+			c.Expect(oversize.MaxSize, gs.Equals, 100)
+			c.Expect(oversize.Size > 200, gs.IsTrue)
+
+			// A header that doesn't fit can't be truncated either.
+			w = newWriter(20, SYSLOG_OVERSIZE_TRUNCATE)
+			defer w.Close()
+			_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+			_, ok = err.(*SyslogOversizeError)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(w.Stats().Oversized, gs.Equals, int64(1))
+		})
+
+		c.Specify("defaults the maximum size per network", func() {
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "udp",
+				Raddr: "127.0.0.1:514"})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			c.Expect(w.maxSize, gs.Equals, 2048)
+			c.Expect(w.oversizePolicy, gs.Equals, SYSLOG_OVERSIZE_TRUNCATE)
+
+			w2 := newWriter(0, "")
+			defer w2.Close()
+			c.Expect(w2.maxSize, gs.Equals, 8192)
+			w3 := newWriter(-1, "")
+			defer w3.Close()
+			c.Expect(w3.maxSize, gs.Equals, 0)
+		})
+
+		c.Specify("defaults the dial timeout", func() {
+			for _, test := range []struct {
+				conf time.Duration
+				exp  time.Duration
+			}{
+				{0, SYSLOG_DIAL_TIMEOUT},
+				{time.Second, time.Second},
+				{-1, 0},
+			} {
+				w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "udp",
+					Raddr: "127.0.0.1:514", DialTimeout: test.conf})
+				c.Assume(err, gs.IsNil)
+				c.Expect(w.dialer.Timeout, gs.Equals, test.exp)
+				w.Close()
+			}
+		})
+
+		c.Specify("rejects unknown policies", func() {
+			_, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp", Raddr: addr,
+				OversizePolicy: "compress"})
+			c.Expect(err.Error(), gs.Equals, "unknown syslog oversize policy: compress")
+		})
+	})
+
+	c.Specify("TestSanitizing", func() {
+		c.Specify("applies the UTF-8 and control character policies", func() {
+			tests := []struct {
+				in, utf8, control, out string
+			}{
+				{"plain\ttext\r\n", SYSLOG_UTF8_REPLACE, SYSLOG_CONTROL_STRIP, "plain\ttext\r\n"},
+				{"bad \xff\xfe byte", SYSLOG_UTF8_KEEP, SYSLOG_CONTROL_ESCAPE, "bad \xff\xfe byte"},
+				{"bad \xff\xfe byte", SYSLOG_UTF8_REPLACE, SYSLOG_CONTROL_KEEP, "bad \uFFFD\uFFFD byte"},
+				{"bad \xff\xfe byte", SYSLOG_UTF8_ESCAPE, SYSLOG_CONTROL_KEEP, `bad \xFF\xFE byte`},
+				{"cut \xe2\x82 €", SYSLOG_UTF8_ESCAPE, SYSLOG_CONTROL_KEEP, `cut \xE2\x82 €`},
+				{"nul\x00bell\x07del\x7f", SYSLOG_UTF8_KEEP, SYSLOG_CONTROL_KEEP, "nul\x00bell\x07del\x7f"},
+				{"nul\x00bell\x07del\x7f", SYSLOG_UTF8_KEEP, SYSLOG_CONTROL_ESCAPE, `nul\x00bell\x07del\x7F`},
+				{"nul\x00bell\x07del\x7f", SYSLOG_UTF8_KEEP, SYSLOG_CONTROL_STRIP, "nulbelldel"},
+			}
+			for _, test := range tests {
+				c.Expect(sanitizeSyslogText(test.in, test.utf8, test.control), gs.Equals, test.out)
+			}
+		})
+
+		c.Specify("fuzzes to valid, control-free and stable output", func() {
+			policies := []struct{ utf8, control string }{
+				{SYSLOG_UTF8_KEEP, SYSLOG_CONTROL_KEEP},
+				{SYSLOG_UTF8_REPLACE, SYSLOG_CONTROL_KEEP},
+				{SYSLOG_UTF8_ESCAPE, SYSLOG_CONTROL_STRIP},
+				{SYSLOG_UTF8_REPLACE, SYSLOG_CONTROL_ESCAPE},
+				{SYSLOG_UTF8_KEEP, SYSLOG_CONTROL_STRIP},
+			}
+			for _, p := range policies {
+				p := p
+				check := func(in []byte) bool {
+					out := sanitizeSyslogText(string(in), p.utf8, p.control)
+					if p.utf8 == SYSLOG_UTF8_KEEP && p.control == SYSLOG_CONTROL_KEEP {
+						return out == string(in)
+					}
+					if p.utf8 != SYSLOG_UTF8_KEEP && !utf8.ValidString(out) {
+						return false
+					}
+					if p.control != SYSLOG_CONTROL_KEEP && strings.IndexFunc(out, isSyslogControl) >= 0 {
+						return false
+					}
+					return sanitizeSyslogText(out, p.utf8, p.control) == out
+				}
+				err := quick.Check(check, &quick.Config{MaxCount: 2000})
+				c.Expect(err, gs.IsNil)
+			}
+		})
+
+		done := make(chan string)
+		addr, sock := startOctetCountedServer(done)
+		defer sock.Close()
+		newWriter := func(conf *SyslogWriterConfig) *SyslogWriter {
+			conf.Network, conf.Raddr = "tcp", addr
+			conf.Framing = SYSLOG_FRAMING_OCTET_COUNTING
+			conf.Format = SYSLOG_FORMAT_RFC5424
+			w, err := NewSyslogWriter(conf)
+			c.Assume(err, gs.IsNil)
+			return w
+		}
+
+		c.Specify("sanitizes payloads and structured data", func() {
+			w := newWriter(&SyslogWriterConfig{InvalidUtf8: SYSLOG_UTF8_REPLACE,
+				ControlChars: SYSLOG_CONTROL_ESCAPE})
+			defer w.Close()
+			sd := []SyslogSDElement{{"origin", []SyslogSDParam{{"ip", "\x00\xff"}}}}
+			_, err := w.WriteMsg(&SyslogMsg{priority: syslog.LOG_USER | syslog.LOG_INFO,
+				prefix: prefix, payload: "a\x1bb\xc0", structuredData: sd})
+			c.Expect(err, gs.IsNil)
+			c.Expect(strings.HasSuffix(<-done, " [origin ip=\"\\\\x00\uFFFD\"] a\\x1Bb\uFFFD"), gs.IsTrue)
+			// the caller's structured data is left alone
+			c.Expect(sd[0].Params[0].Value, gs.Equals, "\x00\xff")
+		})
+
+		c.Specify("marks UTF-8 payloads with a BOM", func() {
+			w := newWriter(&SyslogWriterConfig{Utf8Bom: true, MaxMessageSize: 100})
+			defer w.Close()
+			for _, payload := range []string{"héllo", "bad \xff"} {
+				_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, payload)
+				c.Expect(err, gs.IsNil)
+				rcvd := <-done
+				if utf8.ValidString(payload) {
+					c.Expect(strings.HasSuffix(rcvd, " - "+syslogUtf8Bom+payload), gs.IsTrue)
+				} else {
+					c.Expect(strings.HasSuffix(rcvd, " - "+payload), gs.IsTrue)
+				}
+				msg, err := ParseSyslogMsg(rcvd)
+				c.Assume(err, gs.IsNil)
+				c.Expect(msg.payload, gs.Equals, payload)
+			}
+
+			// The BOM counts towards the maximum size.
+			_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix,
+				strings.Repeat("x", 200))
+			c.Expect(err, gs.IsNil)
+			rcvd := <-done
+			c.Expect(len(rcvd), gs.Equals, 100)
+			c.Expect(strings.HasSuffix(rcvd, SYSLOG_TRUNCATION_MARKER), gs.IsTrue)
+		})
+
+		c.Specify("rejects bad settings", func() {
+			tests := []struct {
+				conf *SyslogWriterConfig
+				err  string
+			}{
+				{&SyslogWriterConfig{Network: "udp", InvalidUtf8: "drop"},
+					"unknown syslog invalid UTF-8 handling: drop"},
+				{&SyslogWriterConfig{Network: "udp", ControlChars: "caret"},
+					"unknown syslog control character handling: caret"},
+				{&SyslogWriterConfig{Network: "udp", Utf8Bom: true},
+					"the UTF-8 BOM requires the rfc5424 format"},
+			}
+			for _, test := range tests {
+				_, err := NewSyslogWriter(test.conf)
+				c.Expect(err.Error(), gs.Equals, test.err)
+			}
+		})
+	})
+
+	c.Specify("TestQueue", func() {
+		bc := newBlockingConn()
+		newQueuedWriter := func(size int, policy string) *SyslogWriter {
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "udp",
+				Raddr: "127.0.0.1:514", QueueSize: size, QueueFullPolicy: policy})
+			c.Assume(err, gs.IsNil)
+			w.mu.Lock()
+			w.dests[0].conn = bc
+			w.mu.Unlock()
+			return w
+		}
+		write := func(w *SyslogWriter, msgs ...string) {
+			for _, msg := range msgs {
+				_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, msg)
+				c.Expect(err, gs.IsNil)
+			}
+		}
+
+		c.Specify("drops the newest message when full", func() {
+			w := newQueuedWriter(2, SYSLOG_QUEUE_DROP_NEWEST)
+			write(w, "1")
+			<-bc.started
+			write(w, "2", "3", "4")
+			c.Expect(w.Stats(), gs.Equals, SyslogWriterStats{QueueDepth: 2, Dropped: 1})
+			close(bc.release)
+			w.Close()
+			c.Expect(bc.written, gs.Equals, []string{"1", "2", "3"})
+		})
+
+		c.Specify("drops the oldest message when full", func() {
+			w := newQueuedWriter(2, SYSLOG_QUEUE_DROP_OLDEST)
+			write(w, "1")
+			<-bc.started
+			write(w, "2", "3", "4")
+			c.Expect(w.Stats(), gs.Equals, SyslogWriterStats{QueueDepth: 2, Dropped: 1})
+			close(bc.release)
+			w.Close()
+			c.Expect(bc.written, gs.Equals, []string{"1", "3", "4"})
+		})
+
+		c.Specify("blocks when full", func() {
+			w := newQueuedWriter(1, SYSLOG_QUEUE_BLOCK)
+			write(w, "1")
+			<-bc.started
+			write(w, "2")
+			returned := make(chan bool)
+			go func() {
+				write(w, "3")
+				close(returned)
+			}()
+			select {
+			case <-returned:
+				c.Expect("write returned", gs.Equals, "write blocked")
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(bc.release)
+			<-returned
+			w.Close()
+			c.Expect(bc.written, gs.Equals, []string{"1", "2", "3"})
+			c.Expect(w.Stats().Dropped, gs.Equals, int64(0))
+		})
+
+		c.Specify("copies queued messages", func() {
+			w := newQueuedWriter(2, SYSLOG_QUEUE_BLOCK)
+			msg := &SyslogMsg{priority: syslog.LOG_USER | syslog.LOG_INFO, payload: "1"}
+			w.WriteMsg(msg)
+			msg.payload = "2"
+			w.WriteMsg(msg)
+			close(bc.release)
+			w.Close()
+			c.Expect(bc.written, gs.Equals, []string{"1", "2"})
+		})
+
+		c.Specify("rejects bad messages and settings up front", func() {
+			w := newQueuedWriter(1, SYSLOG_QUEUE_BLOCK)
+			_, err := w.WriteString(-1, prefix, "bad")
+			c.Expect(err.Error(), gs.Equals, "log/syslog: invalid priority")
+			close(bc.release)
+			w.Close()
+			_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "late")
+			c.Expect(err.Error(), gs.Equals, "syslog writer is closed")
+
+			_, err = NewSyslogWriter(&SyslogWriterConfig{Network: "udp",
+				Raddr: "127.0.0.1:514", QueueSize: 1, QueueFullPolicy: "spill"})
+			c.Expect(err.Error(), gs.Equals, "unknown syslog queue full policy: spill")
+		})
+
+		c.Specify("flushes the queue on close", func() {
+			done := make(chan string, 100)
+			addr, sock, _ := startServer("tcp", "", done, crashy)
+			defer sock.Close()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp", Raddr: addr,
+				QueueSize: 10})
+			c.Assume(err, gs.IsNil)
+			for i := 0; i < 50; i++ {
+				write(w, strconv.Itoa(i))
+			}
+			w.Close()
+			for i := 0; i < 50; i++ {
+				rcvd := <-done
+				c.Expect(strings.HasSuffix(rcvd, fmt.Sprintf(": %d\n", i)), gs.IsTrue)
+			}
+		})
+	})
+
+	c.Specify("TestDestinations", func() {
+		servers := make([]*killableServer, 3)
+		raddrs := make([]string, len(servers))
+		for i := range servers {
+			servers[i] = startKillableServer("")
+			raddrs[i] = servers[i].addr
+			defer os.Remove(raddrs[i])
+			defer servers[i].kill()
+		}
+		newWriter := func(mode string) *SyslogWriter {
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "unix",
+				Raddrs: raddrs, Mode: mode, BackoffMin: 50 * time.Millisecond})
+			c.Assume(err, gs.IsNil)
+			return w
+		}
+		write := func(w *SyslogWriter, ct int) {
+			for i := 0; i < ct; i++ {
+				_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "dest test")
+				c.Expect(err, gs.IsNil)
+			}
+		}
+
+		c.Specify("fails over to secondaries and back to the primary", func() {
+			w := newWriter(SYSLOG_MODE_FAILOVER)
+			defer w.Close()
+			write(w, 3)
+			c.Expect(servers[0].received(), gs.Equals, 3)
+
+			servers[0].kill()
+			write(w, 3)
+			c.Expect(servers[1].received(), gs.Equals, 3)
+			servers[1].kill()
+			write(w, 3)
+			c.Expect(servers[2].received(), gs.Equals, 3)
+			c.Expect(servers[0].received()+servers[1].received(), gs.Equals, 0)
+
+			// the primary is re-checked once its backoff has passed
+			servers[0] = startKillableServer(raddrs[0])
+			time.Sleep(200 * time.Millisecond)
+			write(w, 3)
+			c.Expect(servers[0].received(), gs.Equals, 3)
+			c.Expect(servers[2].received(), gs.Equals, 0)
+		})
+
+		c.Specify("round-robins over the destinations that are up", func() {
+			w := newWriter(SYSLOG_MODE_ROUND_ROBIN)
+			defer w.Close()
+			write(w, 6)
+			for _, server := range servers {
+				c.Expect(server.received(), gs.Equals, 2)
+			}
+
+			servers[1].kill()
+			write(w, 6)
+			c.Expect(servers[0].received()+servers[2].received(), gs.Equals, 6)
+		})
+
+		c.Specify("fans out to every destination that is up", func() {
+			w := newWriter(SYSLOG_MODE_FAN_OUT)
+			defer w.Close()
+			write(w, 2)
+			for _, server := range servers {
+				c.Expect(server.received(), gs.Equals, 2)
+			}
+
+			servers[2].kill()
+			write(w, 2)
+			c.Expect(servers[0].received(), gs.Equals, 2)
+			c.Expect(servers[1].received(), gs.Equals, 2)
+
+			servers[0].kill()
+			servers[1].kill()
+			_, err := w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "lost")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("backs off per destination", func() {
+			w := newWriter(SYSLOG_MODE_FAILOVER)
+			defer w.Close()
+			servers[0].kill()
+			write(w, 1)
+			w.mu.Lock()
+			// the broken connection and the failed reconnect
+			c.Expect(w.dests[0].failures, gs.Equals, 2)
+			c.Expect(w.dests[0].retryAt.After(time.Now()), gs.IsTrue)
+			c.Expect(w.dests[1].failures, gs.Equals, 0)
+			w.mu.Unlock()
+			c.Expect(servers[1].received(), gs.Equals, 1)
+
+			c.Expect(w.backoff(1), gs.Equals, 50*time.Millisecond)
+			c.Expect(w.backoff(3), gs.Equals, 200*time.Millisecond)
+			c.Expect(w.backoff(100), gs.Equals, SYSLOG_BACKOFF_MAX)
+		})
+
+		c.Specify("rejects unknown modes", func() {
+			_, err := NewSyslogWriter(&SyslogWriterConfig{Network: "unix",
+				Raddrs: raddrs, Mode: "random"})
+			c.Expect(err.Error(), gs.Equals, "unknown syslog mode: random")
+		})
+	})
+
+	c.Specify("TestConnectionHealth", func() {
+		c.Specify("backs off from a collector that keeps dropping connections", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer l.Close()
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp",
+				Raddr: l.Addr().String(), BackoffMin: 50 * time.Millisecond,
+				BackoffMax: time.Second})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			for i := 0; i < 60; i++ {
+				w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "flap")
+				time.Sleep(5 * time.Millisecond)
+			}
+			stats := w.Stats()
+			c.Expect(stats.ReconnectAttempts > 0, gs.IsTrue)
+			c.Expect(stats.ReconnectAttempts < 15, gs.IsTrue)
+			c.Expect(stats.LastError, gs.Not(gs.Equals), "")
+		})
+
+		c.Specify("times out writes to a stalled collector", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer l.Close()
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+
+			// A long backoff keeps a slow reconnect into the listener's
+			// backlog from counting as a healthy connection, so the second
+			// timeout surfaces instead of reconnecting again.
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp",
+				Raddr: l.Addr().String(), WriteTimeout: 50 * time.Millisecond,
+				DialTimeout: time.Second, KeepAlive: 10 * time.Second,
+				BackoffMin: time.Hour, BackoffMax: time.Hour})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			conn := <-accepted
+			defer conn.Close()
+
+			big := strings.Repeat("x", 64*1024)
+			for i := 0; i < 1000 && err == nil; i++ {
+				_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, big)
+			}
+			c.Expect(err, gs.Not(gs.IsNil))
+			stats := w.Stats()
+			c.Expect(strings.Contains(stats.LastError, "timeout"), gs.IsTrue)
+			// the broken connection was replaced once before backing off
+			c.Expect(stats.ReconnectAttempts, gs.Equals, int64(1))
+		})
+
+		c.Specify("refreshes idle connections", func() {
+			server := startKillableServer("")
+			defer os.Remove(server.addr)
+			defer server.kill()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "unix",
+				Raddr: server.addr, IdleRefresh: 20 * time.Millisecond})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "one")
+			w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "two")
+			time.Sleep(50 * time.Millisecond)
+			w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "three")
+			c.Expect(server.received(), gs.Equals, 3)
+			server.mu.Lock()
+			c.Expect(len(server.conns), gs.Equals, 2)
+			server.mu.Unlock()
+			c.Expect(w.Stats().ReconnectAttempts, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects inverted backoff bounds", func() {
+			_, err := NewSyslogWriter(&SyslogWriterConfig{Network: "udp",
+				Raddr: "127.0.0.1:514", BackoffMin: time.Second,
+				BackoffMax: time.Millisecond})
+			c.Expect(err.Error(), gs.Equals,
+				"syslog backoff maximum is less than the minimum")
+		})
+	})
+
+	c.Specify("TestLocalSockets", func() {
+		missing := filepath.Join(os.TempDir(), fmt.Sprintf("syslogtest-missing-%d", os.Getpid()))
+
+		c.Specify("finds the daemon in the configured paths", func() {
+			server := startKillableServer("")
+			defer os.Remove(server.addr)
+			defer server.kill()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{
+				LocalPaths: []string{missing, server.addr},
+				LocalTypes: []string{"unix"},
+			})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "local")
+			c.Expect(err, gs.IsNil)
+			c.Expect(server.received(), gs.Equals, 1)
+		})
+
+		c.Specify("re-probes the paths on reconnect", func() {
+			first := startKillableServer("")
+			defer os.Remove(first.addr)
+			defer first.kill()
+			second := startKillableServer("")
+			defer os.Remove(second.addr)
+			defer second.kill()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{
+				LocalPaths: []string{first.addr, second.addr},
+				LocalTypes: []string{"unix"},
+			})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "before")
+			c.Expect(first.received(), gs.Equals, 1)
+
+			first.kill()
+			os.Remove(first.addr)
+			for i := 0; i < 3; i++ {
+				w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "after")
+			}
+			c.Expect(second.received() > 0, gs.IsTrue)
+		})
+
+		c.Specify("connects to abstract sockets", func() {
+			if runtime.GOOS != "linux" {
+				return
+			}
+			server := startKillableServer(fmt.Sprintf("@syslogtest-%d", os.Getpid()))
+			defer server.kill()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{
+				LocalPaths: []string{server.addr},
+			})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			_, err = w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, prefix, "abstract")
+			c.Expect(err, gs.IsNil)
+			c.Expect(server.received(), gs.Equals, 1)
+		})
+
+		c.Specify("reports when no socket is found", func() {
+			_, err := NewSyslogWriter(&SyslogWriterConfig{LocalPaths: []string{missing}})
+			c.Expect(err.Error(), gs.Equals,
+				"Unix syslog delivery error: no syslog socket at "+missing)
+		})
+
+		c.Specify("rejects unknown socket types", func() {
+			_, err := NewSyslogWriter(&SyslogWriterConfig{LocalTypes: []string{"tcp"}})
+			c.Expect(err.Error(), gs.Equals, "unknown local syslog socket type: tcp")
+		})
+	})
+
 	c.Specify("TestConcurrentWrite", func() {
 		addr, sock, _ := startServer("udp", "", make(chan string), crashy)
 		defer sock.Close()
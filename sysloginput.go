@@ -0,0 +1,338 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mozilla-services/heka/pipeline"
+	"github.com/pborman/uuid"
+)
+
+// Receives syslog messages in any of the formats SyslogWriter sends, over
+// datagram or stream sockets, and injects them as Heka messages.
+type SyslogInput struct {
+	network    string
+	maxSize    int
+	listener   net.Listener
+	packetConn net.PacketConn
+	ir         pipeline.InputRunner
+	stopChan   chan struct{}
+	wg         sync.WaitGroup
+	connLock   sync.Mutex
+	conns      map[net.Conn]bool
+}
+
+type SyslogInputConfig struct {
+	// One of "udp", "tcp", "tls", "unix" or "unixgram".
+	Network string `toml:"network"`
+	// Address to listen on, a host and port or a socket path.
+	Address string `toml:"address"`
+	// Server certificate and key, and optional client verification, for
+	// the "tls" network.
+	Tls TlsConfig `toml:"tls"`
+	// Largest accepted message, in bytes. Longer datagrams are truncated,
+	// stream connections sending longer messages are closed.
+	MaxMessageSize int `toml:"max_message_size"`
+}
+
+func (si *SyslogInput) ConfigStruct() interface{} {
+	return &SyslogInputConfig{
+		Network:        "udp",
+		Address:        "127.0.0.1:514",
+		MaxMessageSize: 64 * 1024,
+	}
+}
+
+// Init opens the listening socket, so the address is in use as soon as
+// the plugin is configured.
+func (si *SyslogInput) Init(config interface{}) (err error) {
+	conf := config.(*SyslogInputConfig)
+	si.network = strings.ToLower(conf.Network)
+	si.maxSize = conf.MaxMessageSize
+	if si.maxSize <= 0 {
+		return errors.New("SyslogInput max_message_size must be positive")
+	}
+	if si.network == "unix" || si.network == "unixgram" {
+		// Clear out a socket left behind by an earlier run, but never a
+		// socket something still listens on, or anything else living at
+		// that path.
+		if fi, err := os.Lstat(conf.Address); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 ||
+				!unixSocketRefuses(si.network, conf.Address) {
+
+				return fmt.Errorf("SyslogInput can't listen on %s: address in use",
+					conf.Address)
+			}
+			os.Remove(conf.Address)
+		}
+	}
+
+	switch si.network {
+	case "udp", "udp4", "udp6", "unixgram":
+		si.packetConn, err = net.ListenPacket(si.network, conf.Address)
+	case "tcp", "tcp4", "tcp6", "unix":
+		si.listener, err = net.Listen(si.network, conf.Address)
+	case "tls":
+		var goConf *tls.Config
+		if goConf, err = CreateGoTlsConfig(&conf.Tls); err != nil {
+			return
+		}
+		if len(goConf.Certificates) == 0 {
+			return errors.New("SyslogInput tls requires cert_file and key_file")
+		}
+		si.listener, err = tls.Listen("tcp", conf.Address, goConf)
+	default:
+		return fmt.Errorf("SyslogInput unknown network: %s", conf.Network)
+	}
+	if err != nil {
+		return fmt.Errorf("SyslogInput can't listen on %s: %s", conf.Address, err)
+	}
+	si.stopChan = make(chan struct{})
+	si.conns = make(map[net.Conn]bool)
+	return
+}
+
+// unixSocketRefuses reports whether the socket at path refuses connections,
+// as a socket left behind with nothing listening on it does.
+func unixSocketRefuses(network, path string) bool {
+	conn, err := net.Dial(network, path)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// Addr returns the address the input is listening on.
+func (si *SyslogInput) Addr() net.Addr {
+	if si.packetConn != nil {
+		return si.packetConn.LocalAddr()
+	}
+	return si.listener.Addr()
+}
+
+func (si *SyslogInput) Run(ir pipeline.InputRunner, h pipeline.PluginHelper) (err error) {
+	si.ir = ir
+	if si.packetConn != nil {
+		si.readDatagrams()
+	} else {
+		si.acceptConns()
+	}
+	si.wg.Wait()
+	return nil
+}
+
+func (si *SyslogInput) Stop() {
+	close(si.stopChan)
+	if si.packetConn != nil {
+		si.packetConn.Close()
+		return
+	}
+	si.listener.Close()
+	si.connLock.Lock()
+	defer si.connLock.Unlock()
+	for conn := range si.conns {
+		conn.Close()
+	}
+}
+
+func (si *SyslogInput) stopping() bool {
+	select {
+	case <-si.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// readDatagrams handles one message per datagram.
+func (si *SyslogInput) readDatagrams() {
+	buf := make([]byte, si.maxSize)
+	for {
+		n, _, err := si.packetConn.ReadFrom(buf)
+		if err != nil {
+			if !si.stopping() {
+				si.ir.LogError(fmt.Errorf("SyslogInput read error: %s", err))
+			}
+			return
+		}
+		si.deliver(strings.TrimSuffix(string(buf[:n]), "\n"))
+	}
+}
+
+func (si *SyslogInput) acceptConns() {
+	for {
+		conn, err := si.listener.Accept()
+		if err != nil {
+			if !si.stopping() {
+				si.ir.LogError(fmt.Errorf("SyslogInput accept error: %s", err))
+			}
+			return
+		}
+		si.connLock.Lock()
+		if si.stopping() {
+			si.connLock.Unlock()
+			conn.Close()
+			return
+		}
+		si.conns[conn] = true
+		si.connLock.Unlock()
+
+		si.wg.Add(1)
+		go si.readStream(conn)
+	}
+}
+
+// readStream handles a stream connection, detecting the framing of every
+// message as RFC 6587 allows: octet-counted frames start with a digit,
+// newline delimited ones with the "<" of the priority.
+func (si *SyslogInput) readStream(conn net.Conn) {
+	defer func() {
+		si.connLock.Lock()
+		delete(si.conns, conn)
+		si.connLock.Unlock()
+		conn.Close()
+		si.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := readSyslogFrame(r, si.maxSize)
+		if err != nil {
+			if err != io.EOF && !si.stopping() {
+				si.ir.LogError(fmt.Errorf("SyslogInput dropping connection from %s: %s",
+					conn.RemoteAddr(), err))
+			}
+			return
+		}
+		si.deliver(line)
+	}
+}
+
+// readSyslogFrame reads a single octet-counted or newline terminated
+// message.
+func readSyslogFrame(r *bufio.Reader, maxSize int) (string, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if first[0] >= '0' && first[0] <= '9' {
+		lenStr, err := r.ReadSlice(' ')
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		n, err := strconv.Atoi(string(lenStr[:len(lenStr)-1]))
+		if err != nil {
+			return "", fmt.Errorf("invalid octet count: %q", lenStr)
+		}
+		if n > maxSize {
+			return "", fmt.Errorf("message of %d bytes exceeds max_message_size", n)
+		}
+		msg := make([]byte, n)
+		if _, err = io.ReadFull(r, msg); err != nil {
+			return "", unexpectedEOF(err)
+		}
+		return string(msg), nil
+	}
+
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxSize+1 {
+			return "", errors.New("message exceeds max_message_size")
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line) > 0 {
+				// Accept a final message without a trailing newline.
+				break
+			}
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// deliver parses a message and injects it. Messages that can't be parsed
+// are logged and dropped.
+func (si *SyslogInput) deliver(line string) {
+	if line == "" {
+		return
+	}
+	sm, err := ParseSyslogMsg(line)
+	if err != nil {
+		si.ir.LogError(fmt.Errorf("SyslogInput can't parse message: %s", err))
+		return
+	}
+
+	pack, ok := <-si.ir.InChan()
+	if !ok {
+		return
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType("syslog")
+	msg.SetPayload(sm.payload)
+	copySyslogHeader(sm, msg)
+	copySyslogPriority(sm, msg)
+	addMessageField(msg, "syslog_facility", int(sm.priority>>3))
+	addMessageField(msg, "syslog_severity", int(sm.priority&7))
+	addMessageField(msg, "syslog_format", sm.format)
+	if sm.msgId != "" {
+		addMessageField(msg, "syslog_msgid", sm.msgId)
+	}
+	for _, elem := range sm.structuredData {
+		for _, param := range elem.Params {
+			addMessageField(msg, elem.Id+"."+param.Name, param.Value)
+		}
+	}
+	si.ir.Inject(pack)
+}
+
+func init() {
+	pipeline.RegisterPlugin("SyslogInput", func() interface{} {
+		return new(SyslogInput)
+	})
+}
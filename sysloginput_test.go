@@ -0,0 +1,289 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	"github.com/rafrombrc/gomock/gomock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// tempSocketPath returns an unused path for a unix socket.
+func tempSocketPath() string {
+	f, err := ioutil.TempFile("", "sysloginput")
+	if err != nil {
+		panic(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return f.Name()
+}
+
+func SyslogInputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// runInput starts a SyslogInput with a mock runner, returning the
+	// channel injected packs arrive on and a function stopping the input.
+	runInput := func(input *SyslogInput) (chan *pipeline.PipelinePack, func()) {
+		supply := make(chan *pipeline.PipelinePack, 10)
+		for i := 0; i < cap(supply); i++ {
+			supply <- pipeline.NewPipelinePack(supply)
+		}
+		injected := make(chan *pipeline.PipelinePack, 10)
+		ir := pipelinemock.NewMockInputRunner(ctrl)
+		ir.EXPECT().InChan().Return(supply).AnyTimes()
+		ir.EXPECT().Inject(gomock.Any()).Do(func(pack *pipeline.PipelinePack) {
+			injected <- pack
+		}).Return(nil).AnyTimes()
+		ir.EXPECT().LogError(gomock.Any()).AnyTimes()
+
+		done := make(chan error)
+		go func() {
+			done <- input.Run(ir, nil)
+		}()
+		return injected, func() {
+			input.Stop()
+			<-done
+		}
+	}
+
+	receive := func(injected chan *pipeline.PipelinePack) *pipeline.PipelinePack {
+		select {
+		case pack := <-injected:
+			return pack
+		case <-time.After(2 * time.Second):
+			return nil
+		}
+	}
+
+	c.Specify("A SyslogInput", func() {
+		input := new(SyslogInput)
+		config := input.ConfigStruct().(*SyslogInputConfig)
+
+		c.Specify("receives everything SyslogWriter sends", func() {
+			certs := makeTestCerts()
+			defer os.RemoveAll(certs.dir)
+
+			tests := []struct {
+				network string
+				framing string
+			}{
+				{"udp", ""},
+				{"unixgram", ""},
+				{"tcp", SYSLOG_FRAMING_NEWLINE},
+				{"tcp", SYSLOG_FRAMING_OCTET_COUNTING},
+				{"unix", SYSLOG_FRAMING_NEWLINE},
+				{"unix", SYSLOG_FRAMING_OCTET_COUNTING},
+				{"tls", SYSLOG_FRAMING_OCTET_COUNTING},
+			}
+			formats := []string{SYSLOG_FORMAT_LEGACY, SYSLOG_FORMAT_RFC3164,
+				SYSLOG_FORMAT_RFC5424}
+			sd := []SyslogSDElement{{"origin", []SyslogSDParam{{"ip", "192.0.2.1"}}}}
+
+			for _, test := range tests {
+				input = new(SyslogInput)
+				config = input.ConfigStruct().(*SyslogInputConfig)
+				config.Network = test.network
+				config.Address = "127.0.0.1:0"
+				if strings.HasPrefix(test.network, "unix") {
+					config.Address = tempSocketPath()
+					defer os.Remove(config.Address)
+				}
+				config.Tls.CertFile = certs.serverCertFile
+				config.Tls.KeyFile = certs.serverKeyFile
+				config.Tls.ClientCAs = certs.caFile
+				config.Tls.ClientAuth = "RequireAndVerifyClientCert"
+				err := input.Init(config)
+				c.Assume(err, gs.IsNil)
+				injected, stop := runInput(input)
+
+				writerConf := &SyslogWriterConfig{Network: test.network,
+					Raddr: input.Addr().String(), Framing: test.framing,
+					Hostname: "web1.example.com"}
+				if test.network == "tls" {
+					writerConf.TlsConfig, err = CreateGoTlsConfig(&TlsConfig{
+						RootCAs: certs.caFile, CertFile: certs.certFile,
+						KeyFile: certs.keyFile})
+					c.Assume(err, gs.IsNil)
+				}
+				for _, format := range formats {
+					writerConf.Format = format
+					w, err := NewSyslogWriter(writerConf)
+					c.Assume(err, gs.IsNil)
+					_, err = w.WriteMsg(&SyslogMsg{
+						priority:       syslog.LOG_LOCAL4 | syslog.LOG_WARNING,
+						prefix:         "app",
+						payload:        "round trip",
+						msgId:          "ID47",
+						structuredData: sd,
+					})
+					c.Expect(err, gs.IsNil)
+					w.Close()
+
+					pack := receive(injected)
+					desc := fmt.Sprintf("%s %s %s", test.network, test.framing, format)
+					c.Assume(pack, gs.Not(gs.IsNil))
+					msg := pack.Message
+					c.Expect(msg.GetType(), gs.Equals, "syslog")
+					c.Expect(msg.GetPayload()+" "+desc, gs.Equals, "round trip "+desc)
+					c.Expect(msg.GetHostname(), gs.Equals, "web1.example.com")
+					c.Expect(msg.GetPid(), gs.Equals, int32(os.Getpid()))
+					c.Expect(msg.GetSeverity(), gs.Equals, int32(4))
+					ts := time.Unix(0, msg.GetTimestamp())
+					c.Expect(time.Since(ts) < time.Minute, gs.IsTrue)
+
+					for name, exp := range map[string]interface{}{
+						"syslog_facility":          int64(20),
+						"syslog_severity":          int64(4),
+						"syslog_format":            format,
+						"cef_meta.syslog_facility": "LOCAL4",
+						"cef_meta.syslog_priority": "WARNING",
+						"cef_meta.syslog_ident":    "app",
+					} {
+						val, _ := msg.GetFieldValue(name)
+						c.Expect(val, gs.Equals, exp)
+					}
+					if format == SYSLOG_FORMAT_RFC5424 {
+						val, _ := msg.GetFieldValue("syslog_msgid")
+						c.Expect(val, gs.Equals, "ID47")
+						val, _ = msg.GetFieldValue("origin.ip")
+						c.Expect(val, gs.Equals, "192.0.2.1")
+					}
+				}
+				stop()
+			}
+		})
+
+		c.Specify("replaces a stale socket but not other files", func() {
+			config.Network = "unixgram"
+			config.Address = tempSocketPath()
+			defer os.Remove(config.Address)
+			stale, err := net.ListenPacket("unixgram", config.Address)
+			c.Assume(err, gs.IsNil)
+			stale.Close() // datagram sockets leave their path behind
+			err = input.Init(config)
+			c.Expect(err, gs.IsNil)
+			input.packetConn.Close()
+			os.Remove(config.Address)
+
+			err = ioutil.WriteFile(config.Address, []byte("keep me"), 0644)
+			c.Assume(err, gs.IsNil)
+			input = new(SyslogInput)
+			err = input.Init(config)
+			c.Expect(err.Error(), gs.Equals, fmt.Sprintf(
+				"SyslogInput can't listen on %s: address in use", config.Address))
+			contents, err := ioutil.ReadFile(config.Address)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, "keep me")
+		})
+
+		c.Specify("leaves a socket something listens on alone", func() {
+			for _, network := range []string{"unixgram", "unix"} {
+				config.Network = network
+				config.Address = tempSocketPath()
+				defer os.Remove(config.Address)
+				var live io.Closer
+				var err error
+				if network == "unix" {
+					live, err = net.Listen(network, config.Address)
+				} else {
+					live, err = net.ListenPacket(network, config.Address)
+				}
+				c.Assume(err, gs.IsNil)
+				input = new(SyslogInput)
+				err = input.Init(config)
+				c.Expect(err.Error(), gs.Equals, fmt.Sprintf(
+					"SyslogInput can't listen on %s: address in use", config.Address))
+
+				// The listener still owns the path.
+				conn, err := net.Dial(network, config.Address)
+				c.Expect(err, gs.IsNil)
+				if err == nil {
+					conn.Close()
+				}
+				live.Close()
+			}
+		})
+
+		c.Specify("keeps embedded newlines with octet counting", func() {
+			config.Network = "tcp"
+			config.Address = "127.0.0.1:0"
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			injected, stop := runInput(input)
+			defer stop()
+
+			w, err := NewSyslogWriter(&SyslogWriterConfig{Network: "tcp",
+				Raddr: input.Addr().String(), Format: SYSLOG_FORMAT_RFC5424,
+				Framing: SYSLOG_FRAMING_OCTET_COUNTING})
+			c.Assume(err, gs.IsNil)
+			defer w.Close()
+			w.WriteString(syslog.LOG_USER|syslog.LOG_INFO, "app", "first\nsecond")
+			pack := receive(injected)
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "first\nsecond")
+		})
+
+		c.Specify("requires a certificate for tls", func() {
+			config.Network = "tls"
+			config.Address = "127.0.0.1:0"
+			err := input.Init(config)
+			c.Expect(err.Error(), gs.Equals, "SyslogInput tls requires cert_file and key_file")
+		})
+
+		c.Specify("rejects unknown networks", func() {
+			config.Network = "sctp"
+			err := input.Init(config)
+			c.Expect(err.Error(), gs.Equals, "SyslogInput unknown network: sctp")
+		})
+	})
+
+	c.Specify("readSyslogFrame", func() {
+		r := bufio.NewReader(strings.NewReader(
+			"<13>newline\r\n15 <13>octet\ncount<14>last"))
+		for _, exp := range []string{"<13>newline", "<13>octet\ncount", "<14>last"} {
+			frame, err := readSyslogFrame(r, 100)
+			c.Expect(err, gs.IsNil)
+			c.Expect(frame, gs.Equals, exp)
+		}
+		_, err := readSyslogFrame(r, 100)
+		c.Expect(err, gs.Equals, io.EOF)
+
+		r = bufio.NewReader(strings.NewReader("101 <13>too long"))
+		_, err = readSyslogFrame(r, 100)
+		c.Expect(err.Error(), gs.Equals, "message of 101 bytes exceeds max_message_size")
+
+		r = bufio.NewReader(strings.NewReader("<13>" + strings.Repeat("x", 200) + "\n"))
+		_, err = readSyslogFrame(r, 100)
+		c.Expect(err.Error(), gs.Equals, "message exceeds max_message_size")
+
+		r = bufio.NewReader(strings.NewReader("20 <13>cut short"))
+		_, err = readSyslogFrame(r, 100)
+		c.Expect(err, gs.Equals, io.ErrUnexpectedEOF)
+	})
+}
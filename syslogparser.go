@@ -0,0 +1,220 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseSyslogMsg parses a single syslog message in any of the formats
+// SyslogWriter writes: RFC 5424, RFC 3164 or the legacy format with an
+// RFC 3339 timestamp. The format is detected from the message. RFC 3164
+// timestamps carry no year, so the current one is assumed.
+func ParseSyslogMsg(line string) (msg *SyslogMsg, err error) {
+	msg = new(SyslogMsg)
+	rest, err := parseSyslogPriority(line, msg)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(rest, "1 ") {
+		msg.format = SYSLOG_FORMAT_RFC5424
+		err = parseRfc5424(rest[2:], msg)
+	} else {
+		parseBsdSyslog(rest, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func parseSyslogPriority(line string, msg *SyslogMsg) (rest string, err error) {
+	end := strings.IndexByte(line, '>')
+	if !strings.HasPrefix(line, "<") || end < 2 || end > 4 {
+		return "", errors.New("missing syslog priority")
+	}
+	p, err := strconv.Atoi(line[1:end])
+	if err != nil || p < 0 || p > 191 {
+		return "", fmt.Errorf("invalid syslog priority: %s", line[1:end])
+	}
+	msg.priority = syslog.Priority(p)
+	return line[end+1:], nil
+}
+
+// nextSyslogToken splits off the text up to the next space.
+func nextSyslogToken(s string) (token, rest string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func parseRfc5424(s string, msg *SyslogMsg) (err error) {
+	var ts, procId string
+	ts, s = nextSyslogToken(s)
+	if ts != syslogNilValue {
+		if msg.timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return fmt.Errorf("invalid syslog timestamp: %s", ts)
+		}
+	}
+	msg.hostname, s = nextSyslogToken(s)
+	msg.prefix, s = nextSyslogToken(s)
+	procId, s = nextSyslogToken(s)
+	msg.msgId, s = nextSyslogToken(s)
+	for _, field := range []*string{&msg.hostname, &msg.prefix, &msg.msgId} {
+		if *field == syslogNilValue {
+			*field = ""
+		}
+	}
+	msg.pid, _ = strconv.Atoi(procId)
+
+	if msg.structuredData, s, err = parseStructuredData(s); err != nil {
+		return
+	}
+	if strings.HasPrefix(s, " ") {
+		// The BOM marking UTF-8 messages isn't part of the payload.
+		msg.payload = strings.TrimPrefix(s[1:], syslogUtf8Bom)
+	} else if s != "" {
+		return errors.New("missing space after syslog structured data")
+	}
+	return
+}
+
+// parseStructuredData parses RFC 5424 STRUCTURED-DATA from the start of s,
+// returning the text that follows it.
+func parseStructuredData(s string) (elements []SyslogSDElement, rest string,
+	err error) {
+
+	if strings.HasPrefix(s, syslogNilValue) {
+		return nil, s[1:], nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return nil, "", errors.New("invalid syslog structured data")
+	}
+	for strings.HasPrefix(s, "[") {
+		var elem SyslogSDElement
+		end := strings.IndexAny(s, " ]")
+		if end < 0 {
+			return nil, "", errors.New("unterminated syslog structured data")
+		}
+		elem.Id, s = s[1:end], s[end:]
+		for strings.HasPrefix(s, " ") {
+			var param SyslogSDParam
+			eq := strings.Index(s, `="`)
+			if eq < 0 {
+				return nil, "", errors.New("invalid syslog SD-PARAM")
+			}
+			param.Name, s = s[1:eq], s[eq+2:]
+			if param.Value, s, err = parseSDParamValue(s); err != nil {
+				return nil, "", err
+			}
+			elem.Params = append(elem.Params, param)
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", errors.New("unterminated syslog structured data")
+		}
+		s = s[1:]
+		elements = append(elements, elem)
+	}
+	return elements, s, nil
+}
+
+// parseSDParamValue reads an escaped PARAM-VALUE up to its closing quote.
+func parseSDParamValue(s string) (value, rest string, err error) {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return string(buf), s[i+1:], nil
+		case '\\':
+			if i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+				i++
+				c = s[i]
+			}
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", "", errors.New("unterminated syslog SD-PARAM value")
+}
+
+// Matches an RFC 3164 tag, which may carry a pid as in "app[123]:". Tags
+// holding spaces are only recognised with a pid, so a payload such as
+// "user logged in: alice" isn't taken for one.
+var bsdSyslogTag = regexp.MustCompile(
+	`^(?:([^\s:\[\]]{1,48})(?:\[(\d*)\])?|([^:\[\]]{1,48})\[(\d*)\]):(?: |$)`)
+
+// parseBsdSyslog parses the RFC 3164 and legacy formats. As RFC 3164
+// section 4.3.3 describes, only a message starting with a timestamp has a
+// header; anything else is all payload. In the header, the hostname is
+// optional, since local daemons leave it out.
+func parseBsdSyslog(s string, msg *SyslogMsg) {
+	ts, rest := nextSyslogToken(s)
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+		msg.format = SYSLOG_FORMAT_LEGACY
+		msg.timestamp, s = t, rest
+	} else if t, ok := parseBsdSyslogStamp(s); ok {
+		msg.format = SYSLOG_FORMAT_RFC3164
+		msg.timestamp = bsdSyslogYear(t, time.Now())
+		s = strings.TrimPrefix(s[len(time.Stamp):], " ")
+	} else {
+		msg.payload = s
+		return
+	}
+
+	// The hostname is followed by the tag, which ends in a colon.
+	if token, rest := nextSyslogToken(s); !strings.HasSuffix(token, ":") {
+		msg.hostname = token
+		s = rest
+	}
+	if m := bsdSyslogTag.FindStringSubmatch(s); m != nil {
+		tag, pid := m[1], m[2]
+		if m[3] != "" {
+			tag, pid = m[3], m[4]
+		}
+		msg.prefix = tag
+		msg.pid, _ = strconv.Atoi(pid)
+		s = s[len(m[0]):]
+	}
+	msg.payload = s
+}
+
+// parseBsdSyslogStamp parses the RFC 3164 timestamp at the start of s.
+func parseBsdSyslogStamp(s string) (time.Time, bool) {
+	if len(s) < len(time.Stamp) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], time.Local)
+	return t, err == nil
+}
+
+// bsdSyslogYear puts a year-less RFC 3164 timestamp into the year that
+// brings it closest to now.
+func bsdSyslogYear(t, now time.Time) time.Time {
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.Sub(now) > 24*time.Hour {
+		t = t.AddDate(-1, 0, 0)
+	} else if now.Sub(t) > 364*24*time.Hour {
+		t = t.AddDate(1, 0, 0)
+	}
+	return t
+}
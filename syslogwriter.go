@@ -14,148 +14,1169 @@
 package heka_mozsvc_plugins
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log/syslog"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
+const (
+	// `<PRI>timestamp host tag[pid]: msg`, with an RFC3339 timestamp.
+	SYSLOG_FORMAT_LEGACY = "legacy"
+	// BSD syslog as described by RFC 3164.
+	SYSLOG_FORMAT_RFC3164 = "rfc3164"
+	// The syslog protocol as described by RFC 5424.
+	SYSLOG_FORMAT_RFC5424 = "rfc5424"
+)
+
+const (
+	// Each message is terminated by a newline.
+	SYSLOG_FRAMING_NEWLINE = "newline"
+	// Each message is prefixed by its length, as described by RFC 6587.
+	SYSLOG_FRAMING_OCTET_COUNTING = "octet-counting"
+)
+
+const (
+	// Embedded newlines are sent as is.
+	SYSLOG_NEWLINES_KEEP = "keep"
+	// Embedded CR and LF characters are sent as `\r` and `\n`.
+	SYSLOG_NEWLINES_ESCAPE = "escape"
+	// Embedded CR and LF characters are removed.
+	SYSLOG_NEWLINES_STRIP = "strip"
+)
+
+const (
+	// Writers wait for room in a full queue.
+	SYSLOG_QUEUE_BLOCK = "block"
+	// The oldest queued message is dropped to make room.
+	SYSLOG_QUEUE_DROP_OLDEST = "drop-oldest"
+	// The message being written is dropped.
+	SYSLOG_QUEUE_DROP_NEWEST = "drop-newest"
+)
+
+const (
+	// Messages go to the first destination that accepts them, so the
+	// others only get traffic while the ones before them are down.
+	SYSLOG_MODE_FAILOVER = "failover"
+	// Messages are spread evenly over the destinations that are up.
+	SYSLOG_MODE_ROUND_ROBIN = "round-robin"
+	// Every message goes to every destination that is up.
+	SYSLOG_MODE_FAN_OUT = "fan-out"
+)
+
+// Default bounds of the delay before reconnecting to a destination that
+// failed, which doubles with each consecutive failure.
+const (
+	SYSLOG_BACKOFF_MIN = 100 * time.Millisecond
+	SYSLOG_BACKOFF_MAX = 30 * time.Second
+)
+
+// Default of how long connecting to a destination may take, so failover
+// moves on from a destination that silently drops connection attempts.
+const SYSLOG_DIAL_TIMEOUT = 5 * time.Second
+
+// syslogDialTimeout returns the dialer timeout for a configured one.
+func syslogDialTimeout(d time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return SYSLOG_DIAL_TIMEOUT
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+// How long the queue sender waits before retrying a failed write.
+var syslogRetryInterval = 500 * time.Millisecond
+
+const (
+	// Timestamp precisions for the legacy and RFC 5424 formats. RFC 3164
+	// timestamps always have second precision.
+	SYSLOG_TIMESTAMP_SECONDS      = "s"
+	SYSLOG_TIMESTAMP_MILLISECONDS = "ms"
+	SYSLOG_TIMESTAMP_MICROSECONDS = "us"
+)
+
+var syslogTimestampLayouts = map[string]string{
+	SYSLOG_TIMESTAMP_SECONDS:      time.RFC3339,
+	SYSLOG_TIMESTAMP_MILLISECONDS: "2006-01-02T15:04:05.000Z07:00",
+	SYSLOG_TIMESTAMP_MICROSECONDS: "2006-01-02T15:04:05.000000Z07:00",
+}
+
+// Where the local syslog daemon is looked for when Network is blank. Every
+// path is tried with every socket type, in order. Paths starting with "@"
+// name Linux abstract-namespace sockets.
+var (
+	SYSLOG_LOCAL_PATHS = []string{"/dev/log", "/var/run/syslog"}
+	SYSLOG_LOCAL_TYPES = []string{"unixgram", "unix"}
+)
+
+const (
+	// Oversized messages are cut short, ending in SYSLOG_TRUNCATION_MARKER.
+	SYSLOG_OVERSIZE_TRUNCATE = "truncate"
+	// Oversized messages are split into several messages, each payload
+	// starting with its number and the number of fragments.
+	SYSLOG_OVERSIZE_FRAGMENT = "fragment"
+	// Oversized messages aren't sent, writing them returns a
+	// *SyslogOversizeError.
+	SYSLOG_OVERSIZE_REJECT = "reject"
+)
+
+const (
+	// Appended to the payloads of truncated messages.
+	SYSLOG_TRUNCATION_MARKER = "..."
+	// Prepended to fragment payloads, with the fragment's number and the
+	// number of fragments.
+	SYSLOG_FRAGMENT_PREFIX = "[%d/%d] "
+)
+
+// Default maximum message sizes per network, with "" standing for the
+// local syslog daemon. RFC 5426 recommends supporting 2048 byte UDP
+// messages and RFC 5425 8192 byte TLS messages, which is also the rsyslog
+// default for everything else.
+var SYSLOG_MAX_MESSAGE_SIZES = map[string]int{
+	"":         8192,
+	"udp":      2048,
+	"udp4":     2048,
+	"udp6":     2048,
+	"unixgram": 8192,
+	"tcp":      8192,
+	"tcp4":     8192,
+	"tcp6":     8192,
+	"unix":     8192,
+	"tls":      8192,
+}
+
+const (
+	// Invalid UTF-8 is sent as is.
+	SYSLOG_UTF8_KEEP = "keep"
+	// Each invalid byte is replaced with U+FFFD.
+	SYSLOG_UTF8_REPLACE = "replace"
+	// Each invalid byte is sent as `\xNN`.
+	SYSLOG_UTF8_ESCAPE = "escape"
+)
+
+const (
+	// Control characters are sent as is.
+	SYSLOG_CONTROL_KEEP = "keep"
+	// Control characters are sent as `\xNN`.
+	SYSLOG_CONTROL_ESCAPE = "escape"
+	// Control characters are removed.
+	SYSLOG_CONTROL_STRIP = "strip"
+)
+
+// Marks an RFC 5424 MSG as UTF-8.
+const syslogUtf8Bom = "\xEF\xBB\xBF"
+
+// The RFC 5424 NILVALUE, used for empty header fields and structured data.
+const syslogNilValue = "-"
+
 type SyslogWriter struct {
-	network  string
-	raddr    string
-	hostname string
-	mu       sync.Mutex // guards conn
+	network   string
+	hostname  string
+	format    string
+	tsLayout  string
+	framing   string
+	newlines  string
+	tlsConfig *tls.Config
+	mode      string
+	// Sockets probed for the local syslog daemon.
+	localPaths []string
+	localTypes []string
+	// Largest message sent as is, zero means no limit.
+	maxSize        int
+	oversizePolicy string
+	oversized      int64
+	// Payload and SD-PARAM value sanitization.
+	invalidUtf8  string
+	controlChars string
+	utf8Bom      bool
+	mu           sync.Mutex // guards dests and next
+
+	dests      []*syslogDestination
+	next       int
+	dialer     *net.Dialer
+	backoffMin time.Duration
+	backoffMax time.Duration
+	writeTO    time.Duration
+	idleTO     time.Duration
+	reconnects int64
+	errLock    sync.Mutex // guards lastErr, so Stats never waits on a write
+	lastErr    error
+
+	// Only used when sending asynchronously.
+	queue      chan *SyslogMsg
+	fullPolicy string
+	qLock      sync.RWMutex // guards closing the queue
+	closed     bool
+	stopOnce   sync.Once
+	stopChan   chan struct{}
+	senderDone chan struct{}
+	dropped    int64
+	failed     int64
+}
+
+// Counters describing a SyslogWriter's queue and connections.
+type SyslogWriterStats struct {
+	// Messages currently waiting in the queue.
+	QueueDepth int
+	// Messages dropped because the queue was full.
+	Dropped int64
+	// Failed write attempts by the queue sender.
+	Failed int64
+	// Connection attempts made after the initial connection.
+	ReconnectAttempts int64
+	// Messages longer than the maximum size, whatever the oversize
+	// policy did with them.
+	Oversized int64
+	// The most recent connection or write error, if any.
+	LastError string
+}
+
+// SyslogOversizeError is returned when writing a message that's longer
+// than the maximum size and can't be truncated or fragmented to fit.
+type SyslogOversizeError struct {
+	Size    int
+	MaxSize int
+}
+
+func (e *SyslogOversizeError) Error() string {
+	return fmt.Sprintf("syslog message of %d bytes exceeds the maximum size of %d",
+		e.Size, e.MaxSize)
+}
+
+// SyslogPartialWriteError is returned when writing one of the fragments of
+// an oversized message fails after the earlier ones were written, so
+// writing the message again would send those fragments twice.
+type SyslogPartialWriteError struct {
+	Written int
+	Total   int
+	Err     error
+}
+
+func (e *SyslogPartialWriteError) Error() string {
+	return fmt.Sprintf("syslog message partly written, %d of %d fragments: %s",
+		e.Written, e.Total, e.Err)
+}
+
+// SyslogWriterConfig holds the settings used to create a SyslogWriter.
+type SyslogWriterConfig struct {
+	// Network to dial, an empty string means the local syslog daemon's
+	// unix socket.
+	Network string
+	// Remote address, ignored for the local syslog daemon.
+	Raddr string
+	// Remote addresses, used instead of Raddr to write to several
+	// collectors.
+	Raddrs []string
+	// How messages are distributed over Raddrs, one of the SYSLOG_MODE_*
+	// values. Defaults to SYSLOG_MODE_FAILOVER.
+	Mode string
+	// Wire format, one of the SYSLOG_FORMAT_* values. Defaults to
+	// SYSLOG_FORMAT_LEGACY.
+	Format string
+	// Hostname sent with messages that don't carry their own. Defaults to
+	// os.Hostname(), or "localhost" for the local syslog daemon.
+	Hostname string
+	// Timestamp precision, one of the SYSLOG_TIMESTAMP_* values. Defaults
+	// to SYSLOG_TIMESTAMP_SECONDS.
+	TimestampPrecision string
+	// Message framing for stream networks, one of the SYSLOG_FRAMING_*
+	// values. Defaults to SYSLOG_FRAMING_OCTET_COUNTING for "tls" and to
+	// SYSLOG_FRAMING_NEWLINE for everything else. Datagram networks always
+	// use newline framing.
+	Framing string
+	// What to do with newlines embedded in messages when using newline
+	// framing, one of the SYSLOG_NEWLINES_* values. Defaults to
+	// SYSLOG_NEWLINES_KEEP.
+	Newlines string
+	// TLS settings, required when Network is "tls".
+	TlsConfig *tls.Config
+	// Socket paths and types probed for the local syslog daemon when
+	// Network is blank. Default to SYSLOG_LOCAL_PATHS and
+	// SYSLOG_LOCAL_TYPES.
+	LocalPaths []string
+	LocalTypes []string
+	// Maximum size of a formatted message, without framing. Zero uses the
+	// network's SYSLOG_MAX_MESSAGE_SIZES entry, a negative value means no
+	// limit.
+	MaxMessageSize int
+	// What to do with longer messages, one of the SYSLOG_OVERSIZE_*
+	// values. Defaults to SYSLOG_OVERSIZE_TRUNCATE.
+	OversizePolicy string
+	// What to do with invalid UTF-8 in payloads and SD-PARAM values, one
+	// of the SYSLOG_UTF8_* values. Defaults to SYSLOG_UTF8_KEEP.
+	InvalidUtf8 string
+	// What to do with control characters other than tab, CR and LF, which
+	// are left to the newline handling, in payloads and SD-PARAM values.
+	// One of the SYSLOG_CONTROL_* values, defaults to SYSLOG_CONTROL_KEEP.
+	ControlChars string
+	// Start valid UTF-8 payloads with the BOM RFC 5424 requires of UTF-8
+	// messages. Requires the RFC 5424 format.
+	Utf8Bom bool
+	// Size of the in-memory queue used to send messages asynchronously
+	// from a separate goroutine. Zero means messages are written
+	// synchronously.
+	QueueSize int
+	// What to do when the queue is full, one of the SYSLOG_QUEUE_*
+	// values. Defaults to SYSLOG_QUEUE_BLOCK.
+	QueueFullPolicy string
+	// Bounds of the reconnect backoff. Default to SYSLOG_BACKOFF_MIN and
+	// SYSLOG_BACKOFF_MAX.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// Timeout for establishing a connection. Defaults to
+	// SYSLOG_DIAL_TIMEOUT, a negative value means no timeout.
+	DialTimeout time.Duration
+	// TCP keepalive period. Zero uses the Go default, a negative value
+	// disables keepalives.
+	KeepAlive time.Duration
+	// Deadline for each write. Zero means no deadline.
+	WriteTimeout time.Duration
+	// Connections left unused for this long are replaced before the next
+	// write. Zero means connections are kept indefinitely.
+	IdleRefresh time.Duration
+}
+
+// A single RFC 5424 SD-ELEMENT.
+type SyslogSDElement struct {
+	Id     string
+	Params []SyslogSDParam
+}
 
-	conn syslogServerConn
+// A single RFC 5424 SD-PARAM.
+type SyslogSDParam struct {
+	Name  string
+	Value string
 }
 
 type syslogServerConn interface {
-	writeString(p syslog.Priority, hostname string, prefix string, s string) (int, error)
+	writeString(format string, tsLayout string, msg *SyslogMsg) (int, error)
 	close() error
 }
 
+// A single collector and its connection state.
+type syslogDestination struct {
+	raddr     string
+	conn      syslogServerConn
+	failures  int       // consecutive failed connections or writes
+	retryAt   time.Time // no reconnects are attempted before this
+	connected time.Time
+	lastWrite time.Time
+}
+
 type syslogNetConn struct {
-	conn net.Conn
+	conn         net.Conn
+	framing      string
+	newlines     string
+	writeTimeout time.Duration
 }
 
 func SyslogDial(network, raddr string) (w *SyslogWriter, err error) {
+	return NewSyslogWriter(&SyslogWriterConfig{Network: network, Raddr: raddr})
+}
+
+func NewSyslogWriter(conf *SyslogWriterConfig) (w *SyslogWriter, err error) {
 	var writer *SyslogWriter
-	writer = &SyslogWriter{network: network, raddr: raddr}
-	writer.mu.Lock()
-	defer writer.mu.Unlock()
+	writer = &SyslogWriter{
+		network:   strings.ToLower(conf.Network),
+		format:    conf.Format,
+		framing:   conf.Framing,
+		newlines:  conf.Newlines,
+		tlsConfig: conf.TlsConfig,
+		mode:      conf.Mode,
+
+		localPaths: conf.LocalPaths,
+		localTypes: conf.LocalTypes,
+
+		dialer: &net.Dialer{
+			Timeout:   syslogDialTimeout(conf.DialTimeout),
+			KeepAlive: conf.KeepAlive,
+		},
+		backoffMin: conf.BackoffMin,
+		backoffMax: conf.BackoffMax,
+		writeTO:    conf.WriteTimeout,
+		idleTO:     conf.IdleRefresh,
+	}
+	if writer.backoffMin <= 0 {
+		writer.backoffMin = SYSLOG_BACKOFF_MIN
+	}
+	if writer.backoffMax <= 0 {
+		writer.backoffMax = SYSLOG_BACKOFF_MAX
+	}
+	if writer.backoffMax < writer.backoffMin {
+		return nil, errors.New("syslog backoff maximum is less than the minimum")
+	}
+	if len(writer.localPaths) == 0 {
+		writer.localPaths = SYSLOG_LOCAL_PATHS
+	}
+	if len(writer.localTypes) == 0 {
+		writer.localTypes = SYSLOG_LOCAL_TYPES
+	}
+	for _, t := range writer.localTypes {
+		if t != "unixgram" && t != "unix" {
+			return nil, fmt.Errorf("unknown local syslog socket type: %s", t)
+		}
+	}
+	raddrs := conf.Raddrs
+	if len(raddrs) == 0 || writer.network == "" {
+		raddrs = []string{conf.Raddr}
+	}
+	for _, raddr := range raddrs {
+		writer.dests = append(writer.dests, &syslogDestination{raddr: raddr})
+	}
+	switch writer.mode {
+	case "":
+		writer.mode = SYSLOG_MODE_FAILOVER
+	case SYSLOG_MODE_FAILOVER, SYSLOG_MODE_ROUND_ROBIN, SYSLOG_MODE_FAN_OUT:
+	default:
+		return nil, fmt.Errorf("unknown syslog mode: %s", conf.Mode)
+	}
+	precision := conf.TimestampPrecision
+	if precision == "" {
+		precision = SYSLOG_TIMESTAMP_SECONDS
+	}
+	var ok bool
+	if writer.tsLayout, ok = syslogTimestampLayouts[precision]; !ok {
+		return nil, fmt.Errorf("unknown syslog timestamp precision: %s", precision)
+	}
+	if conf.Hostname != "" {
+		writer.hostname = conf.Hostname
+	} else if writer.network == "" {
+		writer.hostname = "localhost"
+	} else if writer.hostname, err = os.Hostname(); err != nil {
+		return nil, errors.New("Error retrieving hostname")
+	}
+	if writer.network == "tls" && writer.tlsConfig == nil {
+		return nil, errors.New("the tls network requires a TLS config")
+	}
+	if err = writer.checkFraming(); err != nil {
+		return nil, err
+	}
+	if writer.maxSize = conf.MaxMessageSize; writer.maxSize == 0 {
+		writer.maxSize = SYSLOG_MAX_MESSAGE_SIZES[writer.network]
+	} else if writer.maxSize < 0 {
+		writer.maxSize = 0
+	}
+	switch conf.OversizePolicy {
+	case "":
+		writer.oversizePolicy = SYSLOG_OVERSIZE_TRUNCATE
+	case SYSLOG_OVERSIZE_TRUNCATE, SYSLOG_OVERSIZE_FRAGMENT, SYSLOG_OVERSIZE_REJECT:
+		writer.oversizePolicy = conf.OversizePolicy
+	default:
+		return nil, fmt.Errorf("unknown syslog oversize policy: %s", conf.OversizePolicy)
+	}
+	if err = writer.checkSanitizing(conf); err != nil {
+		return nil, err
+	}
+	if conf.QueueSize > 0 {
+		switch conf.QueueFullPolicy {
+		case "":
+			writer.fullPolicy = SYSLOG_QUEUE_BLOCK
+		case SYSLOG_QUEUE_BLOCK, SYSLOG_QUEUE_DROP_OLDEST, SYSLOG_QUEUE_DROP_NEWEST:
+			writer.fullPolicy = conf.QueueFullPolicy
+		default:
+			return nil, fmt.Errorf("unknown syslog queue full policy: %s",
+				conf.QueueFullPolicy)
+		}
+	}
+	switch writer.format {
+	case "":
+		writer.format = SYSLOG_FORMAT_LEGACY
+	case SYSLOG_FORMAT_LEGACY, SYSLOG_FORMAT_RFC3164, SYSLOG_FORMAT_RFC5424:
+	default:
+		return nil, fmt.Errorf("unknown syslog format: %s", conf.Format)
+	}
 
-	err = writer.connect()
+	// Any reachable destination will do, the others are retried later.
+	writer.mu.Lock()
+	for _, d := range writer.dests {
+		if e := writer.connect(d); e != nil {
+			err = e
+		} else {
+			err = nil
+			break
+		}
+	}
+	atomic.StoreInt64(&writer.reconnects, 0)
+	writer.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
+
+	if conf.QueueSize > 0 {
+		writer.queue = make(chan *SyslogMsg, conf.QueueSize)
+		writer.stopChan = make(chan struct{})
+		writer.senderDone = make(chan struct{})
+		go writer.sender()
+	}
 	return writer, err
 }
 
-func (w *SyslogWriter) connect() (err error) {
-	if w.conn != nil {
-		// ignore err from close, it makes sense to continue anyway
-		w.conn.close()
-		w.conn = nil
-	}
-
-	if w.network == "" {
-		w.conn, err = unixSyslog()
-		if w.hostname == "" {
-			w.hostname = "localhost"
-		}
-	} else {
-		var c net.Conn
-		c, err = net.Dial(w.network, w.raddr)
-		if err == nil {
-			w.conn = &syslogNetConn{c}
-			if w.hostname == "" {
-				if w.hostname, err = os.Hostname(); err != nil {
-					return errors.New("Error retrieving hostname")
-				}
-			}
+func (w *SyslogWriter) checkFraming() error {
+	switch w.framing {
+	case "":
+		w.framing = SYSLOG_FRAMING_NEWLINE
+		if w.network == "tls" {
+			w.framing = SYSLOG_FRAMING_OCTET_COUNTING
 		}
+	case SYSLOG_FRAMING_NEWLINE:
+		if w.network == "tls" {
+			return errors.New("the tls network requires octet-counting framing")
+		}
+	case SYSLOG_FRAMING_OCTET_COUNTING:
+		if !isStreamNetwork(w.network) {
+			return fmt.Errorf("octet-counting framing requires a stream network, not '%s'",
+				w.network)
+		}
+	default:
+		return fmt.Errorf("unknown syslog framing: %s", w.framing)
 	}
-	return
+
+	switch w.newlines {
+	case "":
+		w.newlines = SYSLOG_NEWLINES_KEEP
+	case SYSLOG_NEWLINES_KEEP, SYSLOG_NEWLINES_ESCAPE, SYSLOG_NEWLINES_STRIP:
+	default:
+		return fmt.Errorf("unknown syslog newline handling: %s", w.newlines)
+	}
+	return nil
+}
+
+func (w *SyslogWriter) checkSanitizing(conf *SyslogWriterConfig) error {
+	switch w.invalidUtf8 = conf.InvalidUtf8; w.invalidUtf8 {
+	case "":
+		w.invalidUtf8 = SYSLOG_UTF8_KEEP
+	case SYSLOG_UTF8_KEEP, SYSLOG_UTF8_REPLACE, SYSLOG_UTF8_ESCAPE:
+	default:
+		return fmt.Errorf("unknown syslog invalid UTF-8 handling: %s", conf.InvalidUtf8)
+	}
+	switch w.controlChars = conf.ControlChars; w.controlChars {
+	case "":
+		w.controlChars = SYSLOG_CONTROL_KEEP
+	case SYSLOG_CONTROL_KEEP, SYSLOG_CONTROL_ESCAPE, SYSLOG_CONTROL_STRIP:
+	default:
+		return fmt.Errorf("unknown syslog control character handling: %s",
+			conf.ControlChars)
+	}
+	if w.utf8Bom = conf.Utf8Bom; w.utf8Bom && conf.Format != SYSLOG_FORMAT_RFC5424 {
+		return errors.New("the UTF-8 BOM requires the rfc5424 format")
+	}
+	return nil
 }
 
-func (w *SyslogWriter) writeAndRetry(p syslog.Priority,
-	hostname string,
-	prefix string,
-	s string) (n int, err error) {
+func isStreamNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix", "tls":
+		return true
+	}
+	return false
+}
+
+// connect (re)connects to a destination, unless it's backing off after
+// failed attempts.
+func (w *SyslogWriter) connect(d *syslogDestination) (err error) {
+	if d.conn != nil {
+		// ignore err from close, it makes sense to continue anyway
+		d.conn.close()
+		d.conn = nil
+	}
+
+	now := time.Now()
+	if now.Before(d.retryAt) {
+		return fmt.Errorf("syslog destination '%s' is down, retrying in %s",
+			d.raddr, d.retryAt.Sub(now))
+	}
+
+	atomic.AddInt64(&w.reconnects, 1)
+	var c net.Conn
+	switch w.network {
+	case "":
+		c, err = unixSyslog(w.localTypes, w.localPaths)
+	case "tls":
+		c, err = tls.DialWithDialer(w.dialer, "tcp", d.raddr, w.tlsConfig)
+	default:
+		c, err = w.dialer.Dial(w.network, d.raddr)
+	}
+	if err != nil {
+		w.markFailed(d, err)
+		return err
+	}
+	d.conn = &syslogNetConn{conn: c, framing: w.framing, newlines: w.newlines,
+		writeTimeout: w.writeTO}
+	d.connected = now
+	d.lastWrite = now
+	return nil
+}
+
+// markFailed records a failure and puts the destination into backoff.
+func (w *SyslogWriter) markFailed(d *syslogDestination, err error) {
+	w.errLock.Lock()
+	w.lastErr = err
+	w.errLock.Unlock()
+	d.failures++
+	d.retryAt = time.Now().Add(w.backoff(d.failures))
+	if d.conn != nil {
+		d.conn.close()
+		d.conn = nil
+	}
+}
 
+// backoff returns how long to wait after the given number of consecutive
+// failures.
+func (w *SyslogWriter) backoff(failures int) time.Duration {
+	backoff := w.backoffMin
+	for i := 1; i < failures && backoff < w.backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > w.backoffMax {
+		backoff = w.backoffMax
+	}
+	return backoff
+}
+
+func (w *SyslogWriter) writeAndRetry(msg *SyslogMsg) (n int, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.conn != nil {
-		if n, err = w.conn.writeString(p, hostname, prefix, s); err == nil {
+	switch w.mode {
+	case SYSLOG_MODE_FAN_OUT:
+		sent := false
+		for _, d := range w.dests {
+			if dn, e := w.writeDest(d, msg); e == nil {
+				n, sent = dn, true
+			} else {
+				err = e
+			}
+		}
+		if sent {
+			err = nil
+		}
+		return n, err
+	case SYSLOG_MODE_ROUND_ROBIN:
+		start := w.next
+		w.next = (w.next + 1) % len(w.dests)
+		for i := range w.dests {
+			d := w.dests[(start+i)%len(w.dests)]
+			if n, err = w.writeDest(d, msg); err == nil {
+				return n, err
+			}
+		}
+		return n, err
+	}
+
+	for _, d := range w.dests {
+		if n, err = w.writeDest(d, msg); err == nil {
 			return n, err
 		}
 	}
-	if err := w.connect(); err != nil {
+	return n, err
+}
+
+// writeDest writes to a single destination. A broken connection is
+// replaced right away the first time, after that the destination backs
+// off until a connection has stayed up for at least the minimum backoff,
+// so a collector that accepts connections and then drops them doesn't
+// cause a tight reconnect loop.
+func (w *SyslogWriter) writeDest(d *syslogDestination, msg *SyslogMsg) (
+	n int, err error) {
+
+	if err = checkPriority(msg.priority); err != nil {
 		return 0, err
 	}
-	n, err = w.conn.writeString(p, hostname, prefix, s)
+
+	if d.conn != nil && w.idleTO > 0 && time.Since(d.lastWrite) > w.idleTO {
+		d.conn.close()
+		d.conn = nil
+	}
+	if d.conn != nil {
+		if n, err = d.conn.writeString(w.format, w.tsLayout, msg); err == nil {
+			w.wrote(d)
+			return n, err
+		}
+		w.markFailed(d, err)
+		if d.failures == 1 {
+			d.retryAt = time.Time{}
+		}
+	}
+	if err = w.connect(d); err != nil {
+		return 0, err
+	}
+	if n, err = d.conn.writeString(w.format, w.tsLayout, msg); err != nil {
+		w.markFailed(d, err)
+		return 0, err
+	}
+	w.wrote(d)
 	return n, err
 }
 
+// wrote records a successful write.
+func (w *SyslogWriter) wrote(d *syslogDestination) {
+	d.lastWrite = time.Now()
+	if d.lastWrite.Sub(d.connected) >= w.backoffMin {
+		d.failures = 0
+	}
+}
+
 func (w *SyslogWriter) WriteString(p syslog.Priority, prefix string, s string) (n int, err error) {
-	return w.writeAndRetry(p, w.hostname, prefix, s)
+	return w.WriteMsg(&SyslogMsg{priority: p, prefix: prefix, payload: s})
+}
+
+// WriteMsg writes a SyslogMsg, including any structured data it carries
+// when the writer uses the RFC 5424 format. Messages without a hostname
+// or timestamp get the writer's hostname and the current time. Messages
+// longer than the maximum size are handled according to the oversize
+// policy. When the writer has a queue the message is copied onto it and
+// zero bytes are reported as written. A failure after some fragments were
+// written returns a SyslogPartialWriteError.
+func (w *SyslogWriter) WriteMsg(msg *SyslogMsg) (n int, err error) {
+	m := new(SyslogMsg)
+	*m = *msg
+	if m.hostname == "" {
+		m.hostname = w.hostname
+	}
+	if m.timestamp.IsZero() {
+		m.timestamp = time.Now()
+	}
+	if err = checkPriority(m.priority); err != nil {
+		return 0, err
+	}
+	w.sanitize(m)
+	msgs, err := w.fitMsg(m)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, m := range msgs {
+		if w.utf8Bom && m.payload != "" && utf8.ValidString(m.payload) {
+			m.payload = syslogUtf8Bom + m.payload
+		}
+		if w.queue == nil {
+			var mn int
+			mn, err = w.writeAndRetry(m)
+			n += mn
+		} else {
+			err = w.enqueue(m)
+		}
+		if err != nil && i > 0 {
+			return n, &SyslogPartialWriteError{Written: i, Total: len(msgs), Err: err}
+		} else if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// fitMsg returns the messages to send in place of msg, which are msg
+// itself unless it's longer than the maximum size.
+func (w *SyslogWriter) fitMsg(msg *SyslogMsg) ([]*SyslogMsg, error) {
+	if w.maxSize <= 0 {
+		return []*SyslogMsg{msg}, nil
+	}
+	// Measure the payload as it will be sent, the final newline being
+	// part of the framing.
+	if w.framing == SYSLOG_FRAMING_NEWLINE {
+		msg.payload = replaceNewlines(w.newlines, strings.TrimSuffix(msg.payload, "\n"))
+	}
+	line, err := formatSyslogMsg(w.format, w.tsLayout, msg)
+	if err != nil {
+		return nil, err
+	}
+	size := len(line)
+	if w.utf8Bom {
+		size += len(syslogUtf8Bom)
+	}
+	if size <= w.maxSize {
+		return []*SyslogMsg{msg}, nil
+	}
+
+	atomic.AddInt64(&w.oversized, 1)
+	tooLarge := &SyslogOversizeError{Size: size, MaxSize: w.maxSize}
+	// Room for the payload once the header is written.
+	room := w.maxSize - (size - len(msg.payload))
+	if msg.payload == "" {
+		return nil, tooLarge
+	}
+
+	switch w.oversizePolicy {
+	case SYSLOG_OVERSIZE_TRUNCATE:
+		room -= len(SYSLOG_TRUNCATION_MARKER)
+		if room < 0 {
+			return nil, tooLarge
+		}
+		m := *msg
+		m.payload = truncateUtf8(msg.payload, room) + SYSLOG_TRUNCATION_MARKER
+		return []*SyslogMsg{&m}, nil
+	case SYSLOG_OVERSIZE_FRAGMENT:
+		payloads := fragmentPayload(msg.payload, room)
+		if payloads == nil {
+			return nil, tooLarge
+		}
+		msgs := make([]*SyslogMsg, len(payloads))
+		for i, payload := range payloads {
+			m := *msg
+			m.payload = payload
+			msgs[i] = &m
+		}
+		return msgs, nil
+	}
+	return nil, tooLarge
+}
+
+// sanitize applies the writer's UTF-8 and control character handling to a
+// message's payload and SD-PARAM values.
+func (w *SyslogWriter) sanitize(msg *SyslogMsg) {
+	if w.invalidUtf8 == SYSLOG_UTF8_KEEP && w.controlChars == SYSLOG_CONTROL_KEEP {
+		return
+	}
+	msg.payload = sanitizeSyslogText(msg.payload, w.invalidUtf8, w.controlChars)
+	if len(msg.structuredData) == 0 {
+		return
+	}
+	// The elements belong to the caller, so they're copied.
+	elements := make([]SyslogSDElement, len(msg.structuredData))
+	for i, elem := range msg.structuredData {
+		elements[i].Id = elem.Id
+		elements[i].Params = make([]SyslogSDParam, len(elem.Params))
+		for j, param := range elem.Params {
+			elements[i].Params[j] = SyslogSDParam{param.Name,
+				sanitizeSyslogText(param.Value, w.invalidUtf8, w.controlChars)}
+		}
+	}
+	msg.structuredData = elements
+}
+
+// sanitizeSyslogText applies one of the SYSLOG_UTF8_* and one of the
+// SYSLOG_CONTROL_* policies to s. Tab, CR and LF aren't treated as control
+// characters.
+func sanitizeSyslogText(s, invalidUtf8, controlChars string) string {
+	var buf *bytes.Buffer
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		var repl string
+		switch {
+		case r == utf8.RuneError && size == 1 && invalidUtf8 != SYSLOG_UTF8_KEEP:
+			repl = "\uFFFD"
+			if invalidUtf8 == SYSLOG_UTF8_ESCAPE {
+				repl = fmt.Sprintf(`\x%02X`, s[i])
+			}
+		case isSyslogControl(r) && controlChars != SYSLOG_CONTROL_KEEP:
+			if controlChars == SYSLOG_CONTROL_ESCAPE {
+				repl = fmt.Sprintf(`\x%02X`, r)
+			}
+		default:
+			if buf != nil {
+				buf.WriteString(s[i : i+size])
+			}
+			i += size
+			continue
+		}
+		// Only copy once something needs replacing.
+		if buf == nil {
+			buf = bytes.NewBufferString(s[:i])
+		}
+		buf.WriteString(repl)
+		i += size
+	}
+	if buf == nil {
+		return s
+	}
+	return buf.String()
+}
+
+func isSyslogControl(r rune) bool {
+	return (r < 0x20 && r != '\t' && r != '\r' && r != '\n') || r == 0x7f
 }
 
+// fragmentPayload splits payload into numbered fragments of at most room
+// bytes, or returns nil if room is too small to make progress.
+func fragmentPayload(payload string, room int) []string {
+	var chunks []string
+	for n := 1; ; {
+		size := room - len(fmt.Sprintf(SYSLOG_FRAGMENT_PREFIX, n, n))
+		if size < utf8.UTFMax {
+			return nil
+		}
+		chunks = chunks[:0]
+		for s := payload; s != ""; {
+			chunk := truncateUtf8(s, size)
+			chunks = append(chunks, chunk)
+			s = s[len(chunk):]
+		}
+		// Numbering this many fragments may take a wider prefix.
+		if len(strconv.Itoa(len(chunks))) <= len(strconv.Itoa(n)) {
+			break
+		}
+		n = len(chunks)
+	}
+	for i, chunk := range chunks {
+		chunks[i] = fmt.Sprintf(SYSLOG_FRAGMENT_PREFIX, i+1, len(chunks)) + chunk
+	}
+	return chunks
+}
+
+// truncateUtf8 shortens s to at most n bytes without splitting a UTF-8
+// sequence.
+func truncateUtf8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (w *SyslogWriter) enqueue(msg *SyslogMsg) error {
+	w.qLock.RLock()
+	defer w.qLock.RUnlock()
+	if w.closed {
+		return errors.New("syslog writer is closed")
+	}
+
+	switch w.fullPolicy {
+	case SYSLOG_QUEUE_BLOCK:
+		w.queue <- msg
+		return nil
+	case SYSLOG_QUEUE_DROP_OLDEST:
+		for {
+			select {
+			case w.queue <- msg:
+				return nil
+			default:
+			}
+			select {
+			case <-w.queue:
+				atomic.AddInt64(&w.dropped, 1)
+			default:
+			}
+		}
+	}
+	select {
+	case w.queue <- msg:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+	return nil
+}
+
+// sender drains the queue, retrying failed writes until the writer is
+// closed. After that every remaining message gets a single attempt.
+func (w *SyslogWriter) sender() {
+	defer close(w.senderDone)
+	for msg := range w.queue {
+		for {
+			if _, err := w.writeAndRetry(msg); err == nil {
+				break
+			}
+			atomic.AddInt64(&w.failed, 1)
+			select {
+			case <-w.stopChan:
+			case <-time.After(syslogRetryInterval):
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Stats returns the writer's current counters.
+func (w *SyslogWriter) Stats() (stats SyslogWriterStats) {
+	stats.QueueDepth = len(w.queue)
+	stats.Dropped = atomic.LoadInt64(&w.dropped)
+	stats.Failed = atomic.LoadInt64(&w.failed)
+	stats.Oversized = atomic.LoadInt64(&w.oversized)
+
+	stats.ReconnectAttempts = atomic.LoadInt64(&w.reconnects)
+	w.errLock.Lock()
+	defer w.errLock.Unlock()
+	if w.lastErr != nil {
+		stats.LastError = w.lastErr.Error()
+	}
+	return
+}
+
+// Close flushes any queued messages and closes the connection.
 func (w *SyslogWriter) Close() (err error) {
+	if w.queue != nil {
+		w.stopOnce.Do(func() {
+			// stop retrying first so blocked writers can get through
+			close(w.stopChan)
+			w.qLock.Lock()
+			w.closed = true
+			close(w.queue)
+			w.qLock.Unlock()
+		})
+		<-w.senderDone
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.conn != nil {
-		err = w.conn.close()
-		w.conn = nil
-		return err
+	for _, d := range w.dests {
+		if d.conn != nil {
+			if e := d.conn.close(); e != nil {
+				err = e
+			}
+			d.conn = nil
+		}
 	}
-	return nil
+	return err
 }
 
-func (n syslogNetConn) writeString(p syslog.Priority, hostname string, prefix string, msg string) (int, error) {
+func (n syslogNetConn) writeString(format string, tsLayout string, msg *SyslogMsg) (int, error) {
+	line, err := formatSyslogMsg(format, tsLayout, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	if n.writeTimeout > 0 {
+		n.conn.SetWriteDeadline(time.Now().Add(n.writeTimeout))
+	}
+
+	if n.framing == SYSLOG_FRAMING_OCTET_COUNTING {
+		return fmt.Fprintf(n.conn, "%d %s", len(line), line)
+	}
+
+	// ensure it ends in a single \n
+	line = strings.TrimSuffix(line, "\n")
+	return io.WriteString(n.conn, replaceNewlines(n.newlines, line)+"\n")
+}
+
+// replaceNewlines applies one of the SYSLOG_NEWLINES_* policies to s.
+func replaceNewlines(newlines, s string) string {
+	switch newlines {
+	case SYSLOG_NEWLINES_ESCAPE:
+		return newlineEscaper.Replace(s)
+	case SYSLOG_NEWLINES_STRIP:
+		return newlineStripper.Replace(s)
+	}
+	return s
+}
+
+var (
+	newlineEscaper  = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+	newlineStripper = strings.NewReplacer("\r", "", "\n", "")
+)
+
+// formatSyslogMsg renders msg in the requested wire format, without any
+// transport framing.
+func formatSyslogMsg(format string, tsLayout string, msg *SyslogMsg) (string, error) {
+	p := msg.priority
+	if err := checkPriority(p); err != nil {
+		return "", err
+	}
+
+	switch format {
+	case SYSLOG_FORMAT_RFC3164:
+		return fmt.Sprintf("<%d>%s %s %s[%d]: %s", p, msg.timestamp.Format(time.Stamp),
+			syslogHeaderField(msg.hostname, 255), syslogBsdTag(msg.prefix), os.Getpid(),
+			msg.payload), nil
+	case SYSLOG_FORMAT_RFC5424:
+		line := fmt.Sprintf("<%d>1 %s %s %s %d %s %s", p,
+			msg.timestamp.Format(tsLayout),
+			syslogHeaderField(msg.hostname, 255),
+			syslogHeaderField(msg.prefix, 48),
+			os.Getpid(),
+			syslogHeaderField(msg.msgId, 32),
+			formatStructuredData(msg.structuredData))
+		if msg.payload != "" {
+			line += " " + msg.payload
+		}
+		return line, nil
+	}
+	return fmt.Sprintf("<%d>%s %s %s[%d]: %s", p, msg.timestamp.Format(tsLayout),
+		syslogHeaderField(msg.hostname, 255), syslogBsdTag(msg.prefix), os.Getpid(),
+		msg.payload), nil
+}
+
+func checkPriority(p syslog.Priority) error {
 	if p < 0 || p > syslog.LOG_LOCAL7|syslog.LOG_DEBUG {
-		return 0, errors.New("log/syslog: invalid priority")
+		return errors.New("log/syslog: invalid priority")
 	}
+	return nil
+}
 
-	// ensure it ends in a \n
-	nl := ""
-	if !strings.HasSuffix(msg, "\n") {
-		nl = "\n"
+// syslogHeaderField makes s safe for use as an RFC 5424 header field, which
+// may only hold printable US-ASCII up to a maximum length.
+func syslogHeaderField(s string, maxLen int) string {
+	if s == "" {
+		return syslogNilValue
 	}
+	return syslogName(s, maxLen, "")
+}
 
-	timestamp := time.Now().Format(time.RFC3339)
+// syslogBsdTag makes s safe for use as an RFC 3164 TAG, which may hold at
+// most 32 characters. Spaces and the characters that end the tag, ':', '['
+// and ']', are replaced.
+func syslogBsdTag(s string) string {
+	return syslogName(s, 32, ":[]")
+}
+
+// syslogName replaces any character that isn't printable US-ASCII, or that
+// is listed in invalid, with an underscore and truncates to maxLen.
+func syslogName(s string, maxLen int, invalid string) string {
+	b := []byte(s)
+	if len(b) > maxLen {
+		b = b[:maxLen]
+	}
+	for i, c := range b {
+		if c < 33 || c > 126 || strings.IndexByte(invalid, c) != -1 {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
 
-	return fmt.Fprintf(n.conn, "<%d>%s %s %s[%d]: %s%s",
-		p, timestamp, hostname,
-		prefix, os.Getpid(), msg, nl)
+// formatStructuredData renders RFC 5424 STRUCTURED-DATA, escaping the
+// characters the RFC requires in PARAM-VALUEs.
+func formatStructuredData(elements []SyslogSDElement) string {
+	if len(elements) == 0 {
+		return syslogNilValue
+	}
+	buf := new(bytes.Buffer)
+	for _, elem := range elements {
+		buf.WriteByte('[')
+		buf.WriteString(syslogName(elem.Id, 32, "= ]\""))
+		for _, param := range elem.Params {
+			buf.WriteByte(' ')
+			buf.WriteString(syslogName(param.Name, 32, "= ]\""))
+			buf.WriteString("=\"")
+			sdParamEscaper.WriteString(buf, param.Value)
+			buf.WriteByte('"')
+		}
+		buf.WriteByte(']')
+	}
+	return buf.String()
 }
 
+var sdParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
 func (n syslogNetConn) close() error {
 	return n.conn.Close()
 }
 
 // unixSyslog opens a connection to the syslog daemon running on the
-// local machine using a Unix domain socket.
-func unixSyslog() (conn syslogServerConn, err error) {
-	logTypes := []string{"unixgram", "unix"}
-	logPaths := []string{"/dev/log", "/var/run/syslog"}
-	var raddr string
+// local machine using a Unix domain socket. The sockets are probed anew on
+// every call, so a daemon that moved is found again on reconnect.
+func unixSyslog(logTypes, logPaths []string) (conn net.Conn, err error) {
 	for _, network := range logTypes {
 		for _, path := range logPaths {
-			raddr = path
-			conn, err := net.Dial(network, raddr)
-			if err != nil {
-				continue
-			} else {
-				return syslogNetConn{conn}, nil
+			if conn, err = net.Dial(network, path); err == nil {
+				return conn, nil
 			}
 		}
 	}
-	return nil, errors.New("Unix syslog delivery error")
+	return nil, fmt.Errorf("Unix syslog delivery error: no syslog socket at %s",
+		strings.Join(logPaths, ", "))
 }
@@ -28,34 +28,119 @@ func (_m *MockStatsdClient) EXPECT() *_MockStatsdClientRecorder {
 	return _m.recorder
 }
 
-func (_m *MockStatsdClient) IncrementCounter(_param0 string, _param1 int) {
-	_m.ctrl.Call(_m, "IncrementCounter", _param0, _param1)
+func (_m *MockStatsdClient) AddToSet(_param0 string, _param1 string, _param2 ...string) {
+	_s := []interface{}{_param0, _param1}
+	for _, _x := range _param2 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "AddToSet", _s...)
 }
 
-func (_mr *_MockStatsdClientRecorder) IncrementCounter(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "IncrementCounter", arg0, arg1)
+func (_mr *_MockStatsdClientRecorder) AddToSet(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AddToSet", _s...)
 }
 
-func (_m *MockStatsdClient) IncrementSampledCounter(_param0 string, _param1 int, _param2 float32) {
-	_m.ctrl.Call(_m, "IncrementSampledCounter", _param0, _param1, _param2)
+func (_m *MockStatsdClient) AdjustGauge(_param0 string, _param1 float64, _param2 ...string) {
+	_s := []interface{}{_param0, _param1}
+	for _, _x := range _param2 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "AdjustGauge", _s...)
 }
 
-func (_mr *_MockStatsdClientRecorder) IncrementSampledCounter(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "IncrementSampledCounter", arg0, arg1, arg2)
+func (_mr *_MockStatsdClientRecorder) AdjustGauge(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "AdjustGauge", _s...)
 }
 
-func (_m *MockStatsdClient) SendSampledTiming(_param0 string, _param1 int, _param2 float32) {
-	_m.ctrl.Call(_m, "SendSampledTiming", _param0, _param1, _param2)
+func (_m *MockStatsdClient) IncrementCounter(_param0 string, _param1 int64, _param2 ...string) {
+	_s := []interface{}{_param0, _param1}
+	for _, _x := range _param2 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "IncrementCounter", _s...)
 }
 
-func (_mr *_MockStatsdClientRecorder) SendSampledTiming(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendSampledTiming", arg0, arg1, arg2)
+func (_mr *_MockStatsdClientRecorder) IncrementCounter(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "IncrementCounter", _s...)
 }
 
-func (_m *MockStatsdClient) SendTiming(_param0 string, _param1 int) {
-	_m.ctrl.Call(_m, "SendTiming", _param0, _param1)
+func (_m *MockStatsdClient) IncrementSampledCounter(_param0 string, _param1 int64, _param2 float32, _param3 ...string) {
+	_s := []interface{}{_param0, _param1, _param2}
+	for _, _x := range _param3 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "IncrementSampledCounter", _s...)
 }
 
-func (_mr *_MockStatsdClientRecorder) SendTiming(arg0, arg1 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendTiming", arg0, arg1)
+func (_mr *_MockStatsdClientRecorder) IncrementSampledCounter(arg0, arg1, arg2 interface{}, arg3 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1, arg2}, arg3...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "IncrementSampledCounter", _s...)
+}
+
+func (_m *MockStatsdClient) SendHistogram(_param0 string, _param1 float64, _param2 ...string) {
+	_s := []interface{}{_param0, _param1}
+	for _, _x := range _param2 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "SendHistogram", _s...)
+}
+
+func (_mr *_MockStatsdClientRecorder) SendHistogram(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendHistogram", _s...)
+}
+
+func (_m *MockStatsdClient) SendSampledHistogram(_param0 string, _param1 float64, _param2 float32, _param3 ...string) {
+	_s := []interface{}{_param0, _param1, _param2}
+	for _, _x := range _param3 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "SendSampledHistogram", _s...)
+}
+
+func (_mr *_MockStatsdClientRecorder) SendSampledHistogram(arg0, arg1, arg2 interface{}, arg3 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1, arg2}, arg3...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendSampledHistogram", _s...)
+}
+
+func (_m *MockStatsdClient) SendSampledTiming(_param0 string, _param1 float64, _param2 float32, _param3 ...string) {
+	_s := []interface{}{_param0, _param1, _param2}
+	for _, _x := range _param3 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "SendSampledTiming", _s...)
+}
+
+func (_mr *_MockStatsdClientRecorder) SendSampledTiming(arg0, arg1, arg2 interface{}, arg3 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1, arg2}, arg3...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendSampledTiming", _s...)
+}
+
+func (_m *MockStatsdClient) SendTiming(_param0 string, _param1 float64, _param2 ...string) {
+	_s := []interface{}{_param0, _param1}
+	for _, _x := range _param2 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "SendTiming", _s...)
+}
+
+func (_mr *_MockStatsdClientRecorder) SendTiming(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendTiming", _s...)
+}
+
+func (_m *MockStatsdClient) SetGauge(_param0 string, _param1 float64, _param2 ...string) {
+	_s := []interface{}{_param0, _param1}
+	for _, _x := range _param2 {
+		_s = append(_s, _x)
+	}
+	_m.ctrl.Call(_m, "SetGauge", _s...)
+}
+
+func (_mr *_MockStatsdClientRecorder) SetGauge(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	_s := append([]interface{}{arg0, arg1}, arg2...)
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetGauge", _s...)
 }
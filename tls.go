@@ -0,0 +1,123 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2015
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package heka_mozsvc_plugins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var (
+	TLS_VERSION = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+
+	TLS_CLIENT_AUTH = map[string]tls.ClientAuthType{
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+)
+
+// TLS settings, shared by the plugins that can talk TLS, either as clients
+// or as servers.
+type TlsConfig struct {
+	// Name used to verify the server's certificate. Defaults to the host
+	// part of the address being dialed.
+	ServerName string `toml:"server_name"`
+	// PEM encoded certificate and key. Clients present them to servers
+	// that require client authentication, servers always need them.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// PEM encoded CA bundle used to verify the server. Defaults to the
+	// system roots.
+	RootCAs string `toml:"root_cafile"`
+	// Minimum accepted TLS version, one of "TLS10", "TLS11", "TLS12" or
+	// "TLS13". Defaults to "TLS12".
+	MinVersion string `toml:"min_version"`
+	// Skip server certificate verification. Only meant for testing.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+	// Servers only: PEM encoded CA bundle used to verify client
+	// certificates, and the client authentication policy, one of the
+	// TLS_CLIENT_AUTH names. The policy defaults to "NoClientCert".
+	ClientCAs  string `toml:"client_cafile"`
+	ClientAuth string `toml:"client_auth"`
+}
+
+// CreateGoTlsConfig turns a TlsConfig into a crypto/tls config, loading
+// any certificates and keys it refers to.
+func CreateGoTlsConfig(conf *TlsConfig) (goConf *tls.Config, err error) {
+	goConf = &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if conf.MinVersion != "" {
+		var ok bool
+		if goConf.MinVersion, ok = TLS_VERSION[conf.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS min_version: %s", conf.MinVersion)
+		}
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		if conf.CertFile == "" || conf.KeyFile == "" {
+			return nil, errors.New("TLS cert_file and key_file must be set together")
+		}
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile); err != nil {
+			return nil, fmt.Errorf("can't load TLS key pair: %s", err)
+		}
+		goConf.Certificates = []tls.Certificate{cert}
+	}
+
+	if conf.RootCAs != "" {
+		if goConf.RootCAs, err = loadCertPool("root_cafile", conf.RootCAs); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ClientCAs != "" {
+		if goConf.ClientCAs, err = loadCertPool("client_cafile", conf.ClientCAs); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ClientAuth != "" {
+		var ok bool
+		if goConf.ClientAuth, ok = TLS_CLIENT_AUTH[conf.ClientAuth]; !ok {
+			return nil, fmt.Errorf("unknown TLS client_auth: %s", conf.ClientAuth)
+		}
+	}
+	return goConf, nil
+}
+
+func loadCertPool(option, path string) (pool *x509.CertPool, err error) {
+	var pem []byte
+	if pem, err = ioutil.ReadFile(path); err != nil {
+		return nil, fmt.Errorf("can't read TLS %s: %s", option, err)
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}